@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// backgroundTasks runs work which Twilio doesn't need to wait for, such as
+// sending SMS, after the handler has responded, so that it doesn't hold up the
+// call, or run past Twilio's 15 second webhook timeout. A nil
+// *backgroundTasks runs each task straight away, before returning.
+type backgroundTasks struct {
+	wg sync.WaitGroup
+}
+
+// newBackgroundTasks returns a runner with no tasks running
+func newBackgroundTasks() *backgroundTasks {
+	return &backgroundTasks{}
+}
+
+// run runs task in the background, with ctx, whose values, such as the
+// request's logger and span, it keeps, but which isn't cancelled once the
+// request that it came from ends
+func (b *backgroundTasks) run(ctx context.Context, task func(ctx context.Context)) {
+	ctx = context.WithoutCancel(ctx)
+	if b == nil {
+		task(ctx)
+		return
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		task(ctx)
+	}()
+}
+
+// wait waits for the tasks which are running to finish, so that none are lost
+// on shutdown, or returns ctx's error if it is done first
+func (b *backgroundTasks) wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
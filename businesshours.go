@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// routingReason explains why a call was, or wasn't, routed as during business
+// hours
+type routingReason string
+
+const (
+	reasonBusinessHours routingReason = "business_hours"
+	reasonWeekend       routingReason = "weekend"
+	reasonHoliday       routingReason = "holiday"
+	reasonLunch         routingReason = "lunch"
+	reasonAfterHours    routingReason = "after_hours"
+	reasonNotAllowed    routingReason = "caller_not_allowed"
+	reasonOutsideRegion routingReason = "outside_region"
+	reasonNoAnswer      routingReason = "no_answer"
+	reasonVacation      routingReason = "vacation"
+	reasonUnscreened    routingReason = "unscreened"
+	// reasonForcedVoicemail and reasonForcedOpen are used while an admin has
+	// overridden the business hours
+	reasonForcedVoicemail routingReason = "forced_voicemail"
+	reasonForcedOpen      routingReason = "forced_open"
+)
+
+// description returns a human-friendly description of why a call went to
+// voicemail, for use in notifications, e.g., "After-hours"
+func (r routingReason) description() string {
+	switch r {
+	case reasonWeekend:
+		return "Weekend"
+	case reasonHoliday:
+		return "Holiday"
+	case reasonLunch:
+		return "Lunch-break"
+	case reasonAfterHours:
+		return "After-hours"
+	case reasonNoAnswer:
+		return "Unanswered"
+	case reasonVacation:
+		return "Vacation"
+	case reasonForcedVoicemail:
+		return "Closed"
+	case reasonUnscreened:
+		return "Unscreened"
+	default:
+		return ""
+	}
+}
+
+// timeOfDay is a time of day, on a 24-hour clock
+type timeOfDay struct {
+	hour   int
+	minute int
+}
+
+// parseTimeOfDay parses a time of day, either as HH:MM, e.g., 08:30, or as a
+// whole hour, e.g., 8. Times run from 00:00 to 24:00.
+func parseTimeOfDay(value string) (timeOfDay, error) {
+	hourValue, minuteValue, hasMinutes := strings.Cut(strings.TrimSpace(value), ":")
+	if !hasMinutes {
+		minuteValue = "0"
+	}
+
+	hour, err := strconv.Atoi(hourValue)
+	if err != nil {
+		return timeOfDay{}, fmt.Errorf("%q is not a valid time of day; use HH:MM or a whole hour", value)
+	}
+	minute, err := strconv.Atoi(minuteValue)
+	if err != nil || (hasMinutes && len(minuteValue) != 2) {
+		return timeOfDay{}, fmt.Errorf("%q is not a valid time of day; use HH:MM or a whole hour", value)
+	}
+
+	t := timeOfDay{hour: hour, minute: minute}
+	if hour < 0 || minute < 0 || minute > 59 || t.minutes() > 24*60 {
+		return timeOfDay{}, fmt.Errorf("%q is not a valid time of day; it must be between 00:00 and 24:00", value)
+	}
+	return t, nil
+}
+
+// minutes returns the number of minutes from midnight until t
+func (t timeOfDay) minutes() int {
+	return t.hour*60 + t.minute
+}
+
+// String formats t as HH:MM
+func (t timeOfDay) String() string {
+	return fmt.Sprintf("%02d:%02d", t.hour, t.minute)
+}
+
+// UnmarshalJSON parses a time of day from either a whole hour, e.g., 8, or a
+// HH:MM string, e.g., "08:30"
+func (t *timeOfDay) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		value = string(data)
+	}
+
+	parsed, err := parseTimeOfDay(value)
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
+
+// minutesSinceMidnight returns the number of minutes from midnight until t,
+// in t's location
+func minutesSinceMidnight(t time.Time) int {
+	return t.Hour()*60 + t.Minute()
+}
+
+// interval is a period of a day during which the business is open, from start
+// up to, but not including, end
+type interval struct {
+	start timeOfDay
+	end   timeOfDay
+}
+
+// String formats i as HH:MM-HH:MM
+func (i interval) String() string {
+	return i.start.String() + "-" + i.end.String()
+}
+
+// openingHours are the intervals of a single day during which the business is
+// open, e.g., 08:00-12:00 and 13:00-18:00 for an office which closes for lunch
+type openingHours []interval
+
+// newOpeningHours sorts intervals into opening hours, returning an error if
+// any of them are reversed or overlap
+func newOpeningHours(intervals ...interval) (openingHours, error) {
+	hours := openingHours(slices.Clone(intervals))
+	slices.SortFunc(hours, func(a, b interval) int {
+		return a.start.minutes() - b.start.minutes()
+	})
+
+	for i, current := range hours {
+		if current.start.minutes() >= current.end.minutes() {
+			return nil, fmt.Errorf("business hours %s end before they start", current)
+		}
+		if i > 0 && current.start.minutes() < hours[i-1].end.minutes() {
+			return nil, fmt.Errorf("business hours %s overlap %s", hours[i-1], current)
+		}
+	}
+
+	return hours, nil
+}
+
+// parseOpeningHours parses a comma-separated list of HH:MM-HH:MM intervals,
+// e.g., 08:00-12:00,13:00-18:00, into opening hours
+func parseOpeningHours(value string) (openingHours, error) {
+	var intervals []interval
+	for _, part := range strings.Split(value, ",") {
+		startValue, endValue, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, fmt.Errorf("%q is not a valid interval; use HH:MM-HH:MM", strings.TrimSpace(part))
+		}
+		start, err := parseTimeOfDay(startValue)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTimeOfDay(endValue)
+		if err != nil {
+			return nil, err
+		}
+		intervals = append(intervals, interval{start: start, end: end})
+	}
+	return newOpeningHours(intervals...)
+}
+
+// UnmarshalJSON parses opening hours from either a comma-separated string of
+// intervals, e.g., "08:00-12:00,13:00-18:00", or a single interval as an
+// object, e.g., {"start": 8, "end": "17:30"}
+func (h *openingHours) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err == nil {
+		hours, err := parseOpeningHours(value)
+		if err != nil {
+			return err
+		}
+		*h = hours
+		return nil
+	}
+
+	var single struct {
+		Start timeOfDay `json:"start"`
+		End   timeOfDay `json:"end"`
+	}
+	if err := json.Unmarshal(data, &single); err != nil {
+		return err
+	}
+	hours, err := newOpeningHours(interval{start: single.Start, end: single.End})
+	if err != nil {
+		return err
+	}
+	*h = hours
+	return nil
+}
+
+// reasonAt returns whether the business is open at minutes past midnight and,
+// if not, whether that is because it is closed between intervals, e.g., for
+// lunch, or because it is before opening or after closing
+func (h openingHours) reasonAt(minutes int) routingReason {
+	for _, i := range h {
+		if minutes >= i.start.minutes() && minutes < i.end.minutes() {
+			return reasonBusinessHours
+		}
+	}
+	if len(h) > 0 && minutes >= h[0].start.minutes() && minutes < h[len(h)-1].end.minutes() {
+		return reasonLunch
+	}
+	return reasonAfterHours
+}
+
+// schedule holds the business hours for each day of the week. Days without an
+// entry are treated as closed.
+type schedule map[time.Weekday]openingHours
+
+// parseWeekday converts a day of the week into a time.Weekday. The day is
+// either its English name, e.g., Monday, its three-letter abbreviation, e.g.,
+// Mon, or, whatever the language, its number, from 0 for Sunday to 6 for
+// Saturday, with 7 also accepted for Sunday.
+func parseWeekday(name string) (time.Weekday, error) {
+	name = strings.TrimSpace(name)
+	if number, err := strconv.Atoi(name); err == nil && number >= 0 && number <= 7 {
+		return time.Weekday(number % 7), nil
+	}
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(day.String(), name) || strings.EqualFold(day.String()[:3], name) {
+			return day, nil
+		}
+	}
+	return time.Sunday, fmt.Errorf("%q is not a valid day of the week; use a name, e.g., Monday, an abbreviation, e.g., Mon, or a number from 0 (Sunday) to 6 (Saturday)", name)
+}
+
+// closedDays holds the days of the week on which the business is always
+// closed, whatever its hours
+type closedDays map[time.Weekday]bool
+
+// parseClosedDays parses a list of days of the week, e.g., Wednesday, into
+// closed days
+func parseClosedDays(names []string) (closedDays, error) {
+	days := make(closedDays, len(names))
+	for _, name := range names {
+		day, err := parseWeekday(name)
+		if err != nil {
+			return nil, err
+		}
+		days[day] = true
+	}
+	return days, nil
+}
+
+// parseSchedule parses a JSON object keyed by day of the week, e.g.,
+// {"Monday": {"start": 10, "end": "17:30"}, "Tuesday": "08:00-12:00,13:00-18:00"},
+// into a schedule. Times are either whole hours or HH:MM strings.
+func parseSchedule(value string) (schedule, error) {
+	var days map[string]openingHours
+	if err := json.Unmarshal([]byte(value), &days); err != nil {
+		return nil, err
+	}
+
+	sched := make(schedule, len(days))
+	for name, hours := range days {
+		day, err := parseWeekday(name)
+		if err != nil {
+			return nil, err
+		}
+		sched[day] = hours
+	}
+
+	return sched, nil
+}
+
+// holidays holds the dates on which the business is closed. Dates are either
+// specific (YYYY-MM-DD) or recur annually (MM-DD).
+type holidays struct {
+	dates  map[string]bool
+	annual map[string]bool
+}
+
+// parseHolidays parses a list of YYYY-MM-DD and MM-DD dates into holidays
+func parseHolidays(values []string) (holidays, error) {
+	h := holidays{dates: map[string]bool{}, annual: map[string]bool{}}
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", value); err == nil {
+			h.dates[value] = true
+			continue
+		}
+		if _, err := time.Parse("01-02", value); err == nil {
+			h.annual[value] = true
+			continue
+		}
+		return h, fmt.Errorf("%q is not a valid holiday; use YYYY-MM-DD or MM-DD", value)
+	}
+	return h, nil
+}
+
+// loadHolidays loads holidays from the comma-separated HOLIDAYS environment
+// variable and from the JSON array of dates in HOLIDAYS_FILE (holidays.json by
+// default), if that file exists
+func loadHolidays() (holidays, error) {
+	values := strings.Split(os.Getenv("HOLIDAYS"), ",")
+
+	data, err := os.ReadFile(getEnv("HOLIDAYS_FILE", "holidays.json"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return holidays{}, err
+	}
+	if err == nil {
+		var fileValues []string
+		if err := json.Unmarshal(data, &fileValues); err != nil {
+			return holidays{}, err
+		}
+		values = append(values, fileValues...)
+	}
+
+	return parseHolidays(values)
+}
+
+// isHoliday checks if t falls on a holiday. The date is taken in t's location,
+// so t should already be in the configured timezone.
+func (h holidays) isHoliday(t time.Time) bool {
+	return h.dates[t.Format("2006-01-02")] || h.annual[t.Format("01-02")]
+}
+
+// openDates holds the opening hours of specific dates, keyed by YYYY-MM-DD,
+// on which the business is open outside its usual schedule, e.g., an
+// occasional weekend
+type openDates map[string]openingHours
+
+// parseOpenDates parses a JSON object keyed by YYYY-MM-DD date, e.g.,
+// {"2024-06-08": "10:00-14:00"}, with the same opening hours as a day in
+// WORK_HOURS_JSON, into open dates
+func parseOpenDates(value string) (openDates, error) {
+	var dates openDates
+	if err := json.Unmarshal([]byte(value), &dates); err != nil {
+		return nil, err
+	}
+	for date := range dates {
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			return nil, fmt.Errorf("%q is not a valid date; use YYYY-MM-DD", date)
+		}
+	}
+	return dates, nil
+}
+
+// hours returns the opening hours of the date that t falls on, in t's
+// location, if it is one of the open dates
+func (d openDates) hours(t time.Time) (openingHours, bool) {
+	hours, ok := d[t.Format("2006-01-02")]
+	return hours, ok
+}
+
+// isWorkDay checks if day falls within the work week running from start to end,
+// inclusive. Work weeks which wrap around the weekend, e.g., Saturday to
+// Wednesday, are supported.
+func isWorkDay(day, start, end time.Weekday) bool {
+	if start <= end {
+		return day >= start && day <= end
+	}
+	return day >= start || day <= end
+}
+
+// dayBoundary returns the time, on the same day as now and in now's location,
+// at which t occurs. It is built from the wall clock, rather than by adding
+// hours to midnight, so that 08:00 is 08:00 even on days when daylight saving
+// time starts or ends.
+func dayBoundary(now time.Time, t timeOfDay) time.Time {
+	year, month, day := now.Date()
+	return time.Date(year, month, day, t.hour, t.minute, 0, 0, now.Location())
+}
+
+// clock returns the current time. It is a variable so that tests can pin the
+// time that calls are routed at.
+var clock = time.Now
+
+// isDuringBusinessHours returns true if now is within business hours, and
+// false if it is outside them, along with the reason why. now should already
+// be in the configured timezone. Holidays in closed are always outside
+// business hours, even if they are also in open. Otherwise, dates in open
+// have their own hours. Days of the week in closedOn are then always outside
+// business hours and, if sched has any entries, it is used instead of the work
+// week and dayHours.
+func isDuringBusinessHours(now time.Time, closed holidays, open openDates, closedOn closedDays, sched schedule, weekStart time.Weekday, weekEnd time.Weekday, dayHours openingHours) (bool, routingReason) {
+	if closed.isHoliday(now) {
+		return false, reasonHoliday
+	}
+
+	if hours, ok := open.hours(now); ok {
+		reason := hours.reasonAt(minutesSinceMidnight(now))
+		return reason == reasonBusinessHours, reason
+	}
+
+	if closedOn[now.Weekday()] {
+		return false, reasonWeekend
+	}
+
+	if len(sched) > 0 {
+		hours := sched[now.Weekday()]
+		if len(hours) == 0 {
+			return false, reasonWeekend
+		}
+		reason := hours.reasonAt(minutesSinceMidnight(now))
+		return reason == reasonBusinessHours, reason
+	}
+
+	if !isWorkDay(now.Weekday(), weekStart, weekEnd) {
+		return false, reasonWeekend
+	}
+
+	reason := dayHours.reasonAt(minutesSinceMidnight(now))
+	return reason == reasonBusinessHours, reason
+}
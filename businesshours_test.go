@@ -0,0 +1,457 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mustOpeningHours parses value, e.g., 08:00-18:00, failing the test if it
+// isn't valid
+func mustOpeningHours(t *testing.T, value string) openingHours {
+	t.Helper()
+	hours, err := parseOpeningHours(value)
+	if err != nil {
+		t.Fatalf("parseOpeningHours(%q) returned %v", value, err)
+	}
+	return hours
+}
+
+// duringDefaultHours reports whether now is within the default business
+// hours, Monday to Friday 8:00-18:00, with no holidays or open dates
+func duringDefaultHours(t *testing.T, now time.Time) (bool, routingReason) {
+	t.Helper()
+	return isDuringBusinessHours(now, holidays{}, nil, nil, nil, time.Monday, time.Friday, mustOpeningHours(t, "08:00-18:00"))
+}
+
+func TestIsDuringBusinessHoursWeekdayNoon(t *testing.T) {
+	// Wednesday
+	open, reason := duringDefaultHours(t, time.Date(2024, time.June, 12, 12, 0, 0, 0, time.UTC))
+	if !open || reason != reasonBusinessHours {
+		t.Errorf("got %t, %q at noon on a Wednesday, want true, %q", open, reason, reasonBusinessHours)
+	}
+}
+
+func TestIsDuringBusinessHoursWeekendMidnight(t *testing.T) {
+	// Saturday
+	open, reason := duringDefaultHours(t, time.Date(2024, time.June, 15, 0, 0, 0, 0, time.UTC))
+	if open || reason != reasonWeekend {
+		t.Errorf("got %t, %q at midnight on a Saturday, want false, %q", open, reason, reasonWeekend)
+	}
+}
+
+func TestParseTimeOfDay(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    timeOfDay
+		wantErr bool
+	}{
+		{value: "08:30", want: timeOfDay{hour: 8, minute: 30}},
+		{value: "8", want: timeOfDay{hour: 8}},
+		{value: "17", want: timeOfDay{hour: 17}},
+		{value: "24:00", want: timeOfDay{hour: 24}},
+		{value: "8:5", wantErr: true},
+		{value: "08:60", wantErr: true},
+		{value: "24:30", wantErr: true},
+		{value: "eight", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTimeOfDay(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTimeOfDay(%q) returned error %v, want error: %t", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseTimeOfDay(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestIsDuringBusinessHoursHalfHours(t *testing.T) {
+	t.Setenv("WORK_DAY_HOURS", "")
+	t.Setenv("WORK_DAY_START", "08:30")
+	t.Setenv("WORK_DAY_END", "17:30")
+	hours, err := loadWorkDayHours()
+	if err != nil {
+		t.Fatalf("loadWorkDayHours returned %v", err)
+	}
+
+	tests := []struct {
+		hour, minute int
+		want         bool
+	}{
+		{8, 29, false},
+		{8, 30, true},
+		{8, 31, true},
+		{17, 29, true},
+		{17, 30, false},
+	}
+	for _, tt := range tests {
+		// Wednesday
+		now := time.Date(2024, time.June, 12, tt.hour, tt.minute, 0, 0, time.UTC)
+		if got, _ := isDuringBusinessHours(now, holidays{}, nil, nil, nil, time.Monday, time.Friday, hours); got != tt.want {
+			t.Errorf("got %t at %02d:%02d, want %t", got, tt.hour, tt.minute, tt.want)
+		}
+	}
+}
+
+func TestParseOpeningHours(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{value: "08:00-12:00,13:00-18:00"},
+		{value: "13:00-18:00,08:00-12:00"},
+		{value: "08:00-12:00,12:00-18:00"},
+		{value: "08:00-13:00,12:00-18:00", wantErr: true},
+		{value: "18:00-08:00", wantErr: true},
+		{value: "08:00-08:00", wantErr: true},
+		{value: "08:00", wantErr: true},
+	}
+	for _, tt := range tests {
+		if _, err := parseOpeningHours(tt.value); (err != nil) != tt.wantErr {
+			t.Errorf("parseOpeningHours(%q) returned error %v, want error: %t", tt.value, err, tt.wantErr)
+		}
+	}
+}
+
+func TestIsDuringBusinessHoursLunchBreak(t *testing.T) {
+	hours := mustOpeningHours(t, "08:00-12:00,13:00-18:00")
+
+	tests := []struct {
+		hour, minute int
+		want         routingReason
+	}{
+		{7, 59, reasonAfterHours},
+		{11, 59, reasonBusinessHours},
+		{12, 0, reasonLunch},
+		{12, 59, reasonLunch},
+		{13, 0, reasonBusinessHours},
+		{18, 0, reasonAfterHours},
+	}
+	for _, tt := range tests {
+		// Wednesday
+		now := time.Date(2024, time.June, 12, tt.hour, tt.minute, 0, 0, time.UTC)
+		if _, got := isDuringBusinessHours(now, holidays{}, nil, nil, nil, time.Monday, time.Friday, hours); got != tt.want {
+			t.Errorf("got %q at %02d:%02d, want %q", got, tt.hour, tt.minute, tt.want)
+		}
+	}
+}
+
+func TestBusinessHoursEveryWeekday(t *testing.T) {
+	cfg := testConfig(t)
+
+	tests := []struct {
+		name    string
+		now     time.Time
+		want    bool
+		wantWhy routingReason
+	}{
+		{"Monday 10:00", time.Date(2024, time.June, 10, 10, 0, 0, 0, time.UTC), true, reasonBusinessHours},
+		{"Tuesday 10:00", time.Date(2024, time.June, 11, 10, 0, 0, 0, time.UTC), true, reasonBusinessHours},
+		{"Wednesday 10:00", time.Date(2024, time.June, 12, 10, 0, 0, 0, time.UTC), true, reasonBusinessHours},
+		{"Thursday 10:00", time.Date(2024, time.June, 13, 10, 0, 0, 0, time.UTC), true, reasonBusinessHours},
+		{"Friday 10:00", time.Date(2024, time.June, 14, 10, 0, 0, 0, time.UTC), true, reasonBusinessHours},
+		{"Saturday 10:00", time.Date(2024, time.June, 15, 10, 0, 0, 0, time.UTC), false, reasonWeekend},
+		{"Sunday 10:00", time.Date(2024, time.June, 16, 10, 0, 0, 0, time.UTC), false, reasonWeekend},
+		{"Saturday 23:00", time.Date(2024, time.June, 15, 23, 0, 0, 0, time.UTC), false, reasonWeekend},
+		{"just before opening", time.Date(2024, time.June, 12, 7, 59, 59, 0, time.UTC), false, reasonAfterHours},
+		{"at opening", time.Date(2024, time.June, 12, 8, 0, 0, 0, time.UTC), true, reasonBusinessHours},
+		{"just before closing", time.Date(2024, time.June, 12, 17, 59, 59, 0, time.UTC), true, reasonBusinessHours},
+		{"at closing", time.Date(2024, time.June, 12, 18, 0, 0, 0, time.UTC), false, reasonAfterHours},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pinClock(t, tt.now)
+			got, why := cfg.businessHours(clock().In(cfg.location))
+			if got != tt.want || why != tt.wantWhy {
+				t.Errorf("got %t, %q, want %t, %q", got, why, tt.want, tt.wantWhy)
+			}
+		})
+	}
+}
+
+// newYork loads America/New_York, failing the test if it can't be
+func newYork(t *testing.T) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("could not load America/New_York: %v", err)
+	}
+	return loc
+}
+
+func TestIsDuringBusinessHoursDaylightSavingTime(t *testing.T) {
+	loc := newYork(t)
+	hours := mustOpeningHours(t, "08:00-18:00")
+
+	tests := []struct {
+		name string
+		// now is in UTC, so that the test doesn't depend on the DST offset
+		// being applied correctly to build it
+		now  time.Time
+		want bool
+	}{
+		// Clocks go forward at 2:00 on Sunday 10 March 2024, to EDT, UTC-4
+		{"spring forward 07:59 EDT", time.Date(2024, time.March, 10, 11, 59, 0, 0, time.UTC), false},
+		{"spring forward 08:00 EDT", time.Date(2024, time.March, 10, 12, 0, 0, 0, time.UTC), true},
+		{"spring forward 17:59 EDT", time.Date(2024, time.March, 10, 21, 59, 0, 0, time.UTC), true},
+		{"spring forward 18:00 EDT", time.Date(2024, time.March, 10, 22, 0, 0, 0, time.UTC), false},
+		// Clocks go back at 2:00 on Sunday 3 November 2024, to EST, UTC-5
+		{"fall back 07:59 EST", time.Date(2024, time.November, 3, 12, 59, 0, 0, time.UTC), false},
+		{"fall back 08:00 EST", time.Date(2024, time.November, 3, 13, 0, 0, 0, time.UTC), true},
+		{"fall back 17:59 EST", time.Date(2024, time.November, 3, 22, 59, 0, 0, time.UTC), true},
+		{"fall back 18:00 EST", time.Date(2024, time.November, 3, 23, 0, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Both dates are Sundays, so the work week includes every day
+			got, _ := isDuringBusinessHours(tt.now.In(loc), holidays{}, nil, nil, nil, time.Sunday, time.Saturday, hours)
+			if got != tt.want {
+				t.Errorf("got %t at %s, want %t", got, tt.now.In(loc).Format(time.Kitchen+" MST"), tt.want)
+			}
+		})
+	}
+}
+
+func TestIsDuringBusinessHoursOpenDates(t *testing.T) {
+	hours := mustOpeningHours(t, "08:00-18:00")
+	open, err := parseOpenDates(`{"2024-06-15": "10:00-14:00"}`)
+	if err != nil {
+		t.Fatalf("parseOpenDates returned %v", err)
+	}
+	closed, err := parseHolidays([]string{"2024-06-15"})
+	if err != nil {
+		t.Fatalf("parseHolidays returned %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		now      time.Time
+		holidays holidays
+		want     routingReason
+	}{
+		{"open Saturday", time.Date(2024, time.June, 15, 11, 0, 0, 0, time.UTC), holidays{}, reasonBusinessHours},
+		{"before the open Saturday's hours", time.Date(2024, time.June, 15, 9, 59, 0, 0, time.UTC), holidays{}, reasonAfterHours},
+		{"after the open Saturday's hours", time.Date(2024, time.June, 15, 14, 0, 0, 0, time.UTC), holidays{}, reasonAfterHours},
+		{"another Saturday", time.Date(2024, time.June, 22, 11, 0, 0, 0, time.UTC), holidays{}, reasonWeekend},
+		{"open Saturday which is also a holiday", time.Date(2024, time.June, 15, 11, 0, 0, 0, time.UTC), closed, reasonHoliday},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, got := isDuringBusinessHours(tt.now, tt.holidays, open, nil, nil, time.Monday, time.Friday, hours); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsDuringBusinessHoursRecurringHoliday(t *testing.T) {
+	hours := mustOpeningHours(t, "08:00-18:00")
+	closed, err := parseHolidays([]string{"12-25", "2024-11-28"})
+	if err != nil {
+		t.Fatalf("parseHolidays returned %v", err)
+	}
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want routingReason
+	}{
+		{"recurring holiday", time.Date(2024, time.December, 25, 12, 0, 0, 0, time.UTC), reasonHoliday},
+		// A Thursday, so only the holiday closes it
+		{"recurring holiday in a later year", time.Date(2025, time.December, 25, 12, 0, 0, 0, time.UTC), reasonHoliday},
+		{"the day after, in a later year", time.Date(2025, time.December, 26, 12, 0, 0, 0, time.UTC), reasonBusinessHours},
+		{"specific holiday", time.Date(2024, time.November, 28, 12, 0, 0, 0, time.UTC), reasonHoliday},
+		// Also a Thursday, but the holiday was only in 2024
+		{"specific holiday's date in a later year", time.Date(2030, time.November, 28, 12, 0, 0, 0, time.UTC), reasonBusinessHours},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, got := isDuringBusinessHours(tt.now, closed, nil, nil, nil, time.Monday, time.Friday, hours); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseOpenDatesInvalidDate(t *testing.T) {
+	if _, err := parseOpenDates(`{"15/06/2024": "10:00-14:00"}`); err == nil {
+		t.Error("parseOpenDates accepted a date which isn't YYYY-MM-DD")
+	}
+}
+
+func TestDayBoundary(t *testing.T) {
+	loc := newYork(t)
+
+	tests := []struct {
+		name string
+		now  time.Time
+		t    timeOfDay
+		want time.Time
+	}{
+		{"ordinary day", time.Date(2024, time.June, 12, 15, 0, 0, 0, loc), timeOfDay{hour: 8, minute: 30}, time.Date(2024, time.June, 12, 12, 30, 0, 0, time.UTC)},
+		{"DST starts", time.Date(2024, time.March, 10, 15, 0, 0, 0, loc), timeOfDay{hour: 8}, time.Date(2024, time.March, 10, 12, 0, 0, 0, time.UTC)},
+		{"DST ends", time.Date(2024, time.November, 3, 15, 0, 0, 0, loc), timeOfDay{hour: 8}, time.Date(2024, time.November, 3, 13, 0, 0, 0, time.UTC)},
+		{"end of the day", time.Date(2024, time.June, 12, 15, 0, 0, 0, loc), timeOfDay{hour: 24}, time.Date(2024, time.June, 13, 4, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := dayBoundary(tt.now, tt.t)
+			if !got.Equal(tt.want) {
+				t.Errorf("dayBoundary(%s, %s) = %s, want %s", tt.now, tt.t, got, tt.want.In(loc))
+			}
+			if got.Location() != loc {
+				t.Errorf("dayBoundary returned a time in %s, want %s", got.Location(), loc)
+			}
+		})
+	}
+}
+
+func TestIsDuringBusinessHoursInTimezone(t *testing.T) {
+	loc := newYork(t)
+	hours := mustOpeningHours(t, "09:00-17:00")
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want routingReason
+	}{
+		// 13:30 UTC is 09:30 in New York, in summer
+		{"open in New York", time.Date(2024, time.June, 12, 13, 30, 0, 0, time.UTC), reasonBusinessHours},
+		// 22:00 UTC is 18:00 in New York, in summer
+		{"closed in New York", time.Date(2024, time.June, 12, 22, 0, 0, 0, time.UTC), reasonAfterHours},
+		// 02:00 UTC on Saturday is still Friday evening in New York
+		{"Friday evening in New York", time.Date(2024, time.June, 15, 2, 0, 0, 0, time.UTC), reasonAfterHours},
+		// 13:30 UTC is 08:30 in New York, in winter
+		{"before opening in winter", time.Date(2024, time.December, 11, 13, 30, 0, 0, time.UTC), reasonAfterHours},
+		{"the Monday after DST starts, before opening", time.Date(2024, time.March, 11, 12, 59, 0, 0, time.UTC), reasonAfterHours},
+		{"the Monday after DST starts, at opening", time.Date(2024, time.March, 11, 13, 0, 0, 0, time.UTC), reasonBusinessHours},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, got := isDuringBusinessHours(tt.now.In(loc), holidays{}, nil, nil, nil, time.Monday, time.Friday, hours); got != tt.want {
+				t.Errorf("got %q at %s, want %q", got, tt.now.In(loc), tt.want)
+			}
+		})
+	}
+}
+
+func TestBusinessHoursVacation(t *testing.T) {
+	loc := newYork(t)
+	t.Setenv("WORK_TIMEZONE", "America/New_York")
+	// From the start of Tuesday to the end of Thursday, in New York
+	t.Setenv("VACATION_START", "2024-07-02")
+	t.Setenv("VACATION_END", "2024-07-04")
+	cfg := testConfig(t)
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want routingReason
+	}{
+		{"the day before", time.Date(2024, time.July, 1, 10, 0, 0, 0, loc), reasonBusinessHours},
+		{"just before it starts", time.Date(2024, time.July, 1, 23, 59, 59, 0, loc), reasonAfterHours},
+		{"as it starts", time.Date(2024, time.July, 2, 0, 0, 0, 0, loc), reasonVacation},
+		{"during business hours", time.Date(2024, time.July, 3, 10, 0, 0, 0, loc), reasonVacation},
+		{"just before it ends", time.Date(2024, time.July, 4, 23, 59, 59, 0, loc), reasonVacation},
+		{"as it ends", time.Date(2024, time.July, 5, 0, 0, 0, 0, loc), reasonAfterHours},
+		{"the day after", time.Date(2024, time.July, 5, 10, 0, 0, 0, loc), reasonBusinessHours},
+		// 03:30 UTC on Tuesday is still Monday evening in New York
+		{"before it starts in New York", time.Date(2024, time.July, 2, 3, 30, 0, 0, time.UTC), reasonAfterHours},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, got := cfg.businessHours(tt.now.In(cfg.location)); got != tt.want {
+				t.Errorf("got %q at %s, want %q", got, tt.now.In(loc), tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigInvalidVacation(t *testing.T) {
+	tests := []struct {
+		name       string
+		start, end string
+	}{
+		{"only a start", "2024-07-02", ""},
+		{"only an end", "", "2024-07-04"},
+		{"end before start", "2024-07-04", "2024-07-02"},
+		{"not a date", "2 July", "2024-07-04"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MY_PHONE_NUMBER", "+14155550100")
+			t.Setenv("TWILIO_PHONE_NUMBER", "+14155550199")
+			t.Setenv("HOLIDAYS_FILE", filepath.Join(t.TempDir(), "holidays.json"))
+			t.Setenv("VACATION_START", tt.start)
+			t.Setenv("VACATION_END", tt.end)
+
+			_, err := loadConfig()
+			if err == nil || !strings.Contains(err.Error(), "VACATION_") {
+				t.Errorf("got error %v for VACATION_START %q and VACATION_END %q, want one about the vacation", err, tt.start, tt.end)
+			}
+		})
+	}
+}
+
+func TestNextChange(t *testing.T) {
+	tests := []struct {
+		name      string
+		holidays  string
+		openDates string
+		now       time.Time
+		want      time.Time
+	}{
+		{
+			name: "Friday evening",
+			now:  time.Date(2024, time.June, 14, 19, 0, 0, 0, time.UTC),
+			want: time.Date(2024, time.June, 17, 8, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "Friday afternoon",
+			now:  time.Date(2024, time.June, 14, 17, 0, 0, 0, time.UTC),
+			want: time.Date(2024, time.June, 14, 18, 0, 0, 0, time.UTC),
+		},
+		{
+			// Christmas is a Wednesday
+			name:     "holiday eve",
+			holidays: "12-25",
+			now:      time.Date(2024, time.December, 24, 19, 0, 0, 0, time.UTC),
+			want:     time.Date(2024, time.December, 26, 8, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "Friday evening before an open Saturday",
+			openDates: `{"2024-06-15": "10:00-14:00"}`,
+			now:       time.Date(2024, time.June, 14, 19, 0, 0, 0, time.UTC),
+			want:      time.Date(2024, time.June, 15, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "during an open Saturday",
+			openDates: `{"2024-06-15": "10:00-14:00"}`,
+			now:       time.Date(2024, time.June, 15, 11, 0, 0, 0, time.UTC),
+			want:      time.Date(2024, time.June, 15, 14, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "weekday with shorter open hours",
+			openDates: `{"2024-06-17": "12:00-13:00"}`,
+			now:       time.Date(2024, time.June, 14, 19, 0, 0, 0, time.UTC),
+			want:      time.Date(2024, time.June, 17, 12, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unsetenv(t, "WORK_TIMEZONE")
+			t.Setenv("HOLIDAYS", tt.holidays)
+			t.Setenv("OPEN_DATES", tt.openDates)
+			cfg := testConfig(t)
+			pinClock(t, tt.now)
+
+			got, ok := nextChange(tt.now, cfg)
+			if !ok || !got.Equal(tt.want) {
+				t.Errorf("got %s, %t, want %s", got, ok, tt.want)
+			}
+		})
+	}
+}
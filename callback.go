@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/twilio/twilio-go/twiml"
+)
+
+// callbackKey returns the key which callers press, in the IVR menu, to ask to
+// be called back, rather than leave a voicemail, or an empty string if
+// MENU_CALLBACK_KEY isn't set
+func callbackKey() string {
+	return os.Getenv("MENU_CALLBACK_KEY")
+}
+
+// callbackPrompt is what callers who ask to be called back are asked
+const callbackPrompt = "Please enter the number to call you back on, followed by the pound key."
+
+// callbackNumberElements returns the TwiML which asks the caller to enter the
+// number to call them back on, with prompt, and sends it to /callback-number.
+// attempt counts their tries at entering one, so that each try is a distinct
+// request, and entering the same digits again isn't rejected as a replay. If
+// they don't enter one, they are sent to voicemail instead.
+func callbackNumberElements(cfg config, prompt string, attempt int) []twiml.Element {
+	gather := &twiml.VoiceGather{
+		Action:      publicURL("/callback-number?" + url.Values{"attempt": {strconv.Itoa(attempt)}}.Encode()),
+		FinishOnKey: "#",
+		Timeout:     strconv.Itoa(cfg.menuTimeout),
+		InnerElements: []twiml.Element{
+			greetingElement(prompt),
+		},
+	}
+	return []twiml.Element{gather, voicemailRedirect("")}
+}
+
+// handleCallbackNumber returns a handler which receives the callback number
+// that the caller entered, reads it back to the caller before hanging up, and
+// sends it by SMS, from TWILIO_PHONE_NUMBER, using sender, to each of the
+// configured numbers, with tasks, so that the caller isn't kept waiting.
+// Numbers without a country code are taken to be in DEFAULT_REGION. If the
+// number isn't valid, the caller is asked to enter it again.
+func handleCallbackNumber(sender messageSender, tasks *backgroundTasks, cfg config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller := r.FormValue("From")
+		logger := requestLogger(r).With("caller", caller)
+
+		number, err := normalizeNumber(r.FormValue("Digits"))
+		var elements []twiml.Element
+		if err != nil {
+			logger.Info("Caller entered an invalid callback number", "digits", r.FormValue("Digits"))
+			elements = callbackNumberElements(cfg, "Sorry, that isn't a valid phone number. "+callbackPrompt, requestAttempt(r)+1)
+		} else {
+			callsTotal.WithLabelValues("callback").Inc()
+			logger.Info("Routing call", "decision", "callback", "callback_number", number)
+
+			body := fmt.Sprintf("Callback requested by %s: %s", caller, number)
+			tasks.run(r.Context(), func(ctx context.Context) {
+				for _, recipient := range cfg.notifyNumbers {
+					if _, err := sendVoicemailSMS(ctx, sender, recipient, cfg.twilioPhoneNumber, body, cfg.apiTimeout, cfg.retry, logger.With("recipient", recipient)); err != nil {
+						notificationFailuresTotal.WithLabelValues("sms").Inc()
+					}
+				}
+			})
+
+			elements = []twiml.Element{
+				greetingElement(fmt.Sprintf("Thanks. We'll call you back on %s. Goodbye.", spokenNumber(number))),
+				&twiml.VoiceHangup{},
+			}
+		}
+
+		twimlResult, err := twiml.Voice(elements)
+		if err != nil {
+			appError(w, fmt.Errorf("could not confirm the callback number. reason: %s", err))
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/xml")
+		w.Write([]byte(twimlResult))
+	}
+}
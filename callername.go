@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	lookups "github.com/twilio/twilio-go/rest/lookups/v2"
+)
+
+// phoneNumberLooker looks up information about phone numbers. It is satisfied
+// by the Twilio REST client's LookupsV2 service.
+type phoneNumberLooker interface {
+	FetchPhoneNumber(phoneNumber string, params *lookups.FetchPhoneNumberParams) (*lookups.LookupsV2PhoneNumber, error)
+}
+
+// cachedCallerName is a caller name, which may be empty if the number has none,
+// and when it should be looked up again
+type cachedCallerName struct {
+	name    string
+	expires time.Time
+}
+
+// callerNames looks up the names of callers with Twilio Lookup, caching the
+// results for ttl so that repeated calls from the same number are only looked
+// up, and charged for, once. A nil *callerNames never finds a name.
+type callerNames struct {
+	looker  phoneNumberLooker
+	timeout time.Duration
+	ttl     time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedCallerName
+}
+
+// newCallerNames returns a caller name lookup, using looker, if it is enabled
+// with CALLER_NAME_LOOKUP, or nil otherwise
+func newCallerNames(looker phoneNumberLooker, cfg config) *callerNames {
+	if !cfg.callerNameLookup {
+		return nil
+	}
+	return &callerNames{
+		looker:  looker,
+		timeout: cfg.apiTimeout,
+		ttl:     cfg.callerNameCacheTTL,
+		cache:   map[string]cachedCallerName{},
+	}
+}
+
+// lookup returns the name registered to number, or an empty string if it has
+// none or it couldn't be looked up, in which case a warning is logged. Expired
+// names are deleted from the cache, so that it only holds recent callers.
+func (c *callerNames) lookup(ctx context.Context, number string, logger *slog.Logger) string {
+	if c == nil || number == "" {
+		return ""
+	}
+
+	c.mu.Lock()
+	now := clock()
+	for cachedNumber, cached := range c.cache {
+		if !now.Before(cached.expires) {
+			delete(c.cache, cachedNumber)
+		}
+	}
+	cached, ok := c.cache[number]
+	c.mu.Unlock()
+	if ok {
+		return cached.name
+	}
+
+	fetchCtx, span := tracer.Start(ctx, "twilio.lookup_caller_name")
+	name, err := c.fetch(fetchCtx, number)
+	endSpan(span, err)
+	if err != nil {
+		logger.Warn("Could not look up caller name", "error", err)
+		return ""
+	}
+
+	c.mu.Lock()
+	c.cache[number] = cachedCallerName{name: name, expires: clock().Add(c.ttl)}
+	c.mu.Unlock()
+	return name
+}
+
+// fetch looks up the name registered to number with Twilio Lookup, giving up
+// after c's timeout
+func (c *callerNames) fetch(ctx context.Context, number string) (string, error) {
+	type result struct {
+		resp *lookups.LookupsV2PhoneNumber
+		err  error
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	done := make(chan result, 1)
+	go func() {
+		timer := prometheus.NewTimer(twilioAPIDuration.WithLabelValues("lookup_caller_name"))
+		resp, err := c.looker.FetchPhoneNumber(number, (&lookups.FetchPhoneNumberParams{}).SetFields("caller_name"))
+		timer.ObserveDuration()
+		done <- result{resp, err}
+	}()
+
+	var res result
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case res = <-done:
+	}
+	if res.err != nil {
+		return "", res.err
+	}
+
+	if res.resp == nil || res.resp.CallerName == nil {
+		return "", nil
+	}
+	fields, _ := (*res.resp.CallerName).(map[string]interface{})
+	name, _ := fields["caller_name"].(string)
+	return name, nil
+}
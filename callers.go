@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/twilio/twilio-go/twiml"
+)
+
+// matchesNumber checks if number matches any of patterns. A pattern is either
+// an exact number, e.g., +14155552671, or a prefix followed by a *, e.g.,
+// +1900*, which matches any number starting with that prefix.
+func matchesNumber(number string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(number, prefix) {
+				return true
+			}
+			continue
+		}
+		if number == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// isBlockedCaller checks if caller matches any of BLOCKED_NUMBERS
+func isBlockedCaller(cfg config, caller string) bool {
+	return matchesNumber(caller, cfg.blockedNumbers)
+}
+
+// isAllowedCaller checks if caller may have their call forwarded. If
+// ALLOWED_NUMBERS is set, only callers matching it may; otherwise, all
+// callers may.
+func isAllowedCaller(cfg config, caller string) bool {
+	return len(cfg.allowedNumbers) == 0 || matchesNumber(caller, cfg.allowedNumbers)
+}
+
+// countryCodePattern matches international calling codes, e.g., +1 or +48
+var countryCodePattern = regexp.MustCompile(`^\+[1-9]\d{0,2}$`)
+
+// parseCountryCodes parses FORWARD_COUNTRY_CODES, a comma-separated list of
+// international calling codes
+func parseCountryCodes(value string) ([]string, error) {
+	codes := splitList(value)
+	for _, code := range codes {
+		if !countryCodePattern.MatchString(code) {
+			return nil, fmt.Errorf("FORWARD_COUNTRY_CODES is invalid: %q is not a calling code; it must be a + followed by up to 3 digits, e.g., +1", code)
+		}
+	}
+	return codes, nil
+}
+
+// isForwardedRegion checks if caller's number has one of the calling codes in
+// FORWARD_COUNTRY_CODES, e.g., +1 for North America. If it isn't set, callers
+// from every country may have their call forwarded. Calling codes are prefix
+// free, so matching the start of the number is enough.
+func isForwardedRegion(cfg config, caller string) bool {
+	if len(cfg.forwardCountryCodes) == 0 {
+		return true
+	}
+	for _, code := range cfg.forwardCountryCodes {
+		if strings.HasPrefix(caller, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// blockedCallerElements returns the TwiML for blocked callers. By default, the
+// call is rejected, but if BLOCKED_MESSAGE is set, it is spoken to the caller
+// before hanging up instead.
+func blockedCallerElements(cfg config) []twiml.Element {
+	if cfg.blockedMessage == "" {
+		return []twiml.Element{&twiml.VoiceReject{}}
+	}
+	return []twiml.Element{
+		greetingElement(cfg.blockedMessage),
+		&twiml.VoiceHangup{},
+	}
+}
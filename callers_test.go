@@ -0,0 +1,86 @@
+package main
+
+import "testing"
+
+func TestMatchesNumber(t *testing.T) {
+	patterns := []string{"+14155552671", "+1900*"}
+
+	tests := []struct {
+		number string
+		want   bool
+	}{
+		{"+14155552671", true},
+		{"+14155552672", false},
+		{"+19005550100", true},
+		{"+1900", true},
+		{"+1800555010", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := matchesNumber(tt.number, patterns); got != tt.want {
+			t.Errorf("matchesNumber(%q) = %t, want %t", tt.number, got, tt.want)
+		}
+	}
+}
+
+func TestIsAllowedCaller(t *testing.T) {
+	t.Setenv("ALLOWED_NUMBERS", "")
+	if !isAllowedCaller(testConfig(t), "+14155552671") {
+		t.Error("caller isn't allowed without ALLOWED_NUMBERS, want every caller allowed")
+	}
+
+	t.Setenv("ALLOWED_NUMBERS", "+1415*")
+	cfg := testConfig(t)
+	if !isAllowedCaller(cfg, "+14155552671") {
+		t.Error("caller matching ALLOWED_NUMBERS isn't allowed")
+	}
+	if isAllowedCaller(cfg, "+12125550100") {
+		t.Error("caller not matching ALLOWED_NUMBERS is allowed")
+	}
+}
+
+func TestIsBlockedCaller(t *testing.T) {
+	t.Setenv("BLOCKED_NUMBERS", "+1900*,+14155552671")
+	cfg := testConfig(t)
+	if !isBlockedCaller(cfg, "+19005550100") || !isBlockedCaller(cfg, "+14155552671") {
+		t.Error("caller matching BLOCKED_NUMBERS isn't blocked")
+	}
+	if isBlockedCaller(cfg, "+14155552672") {
+		t.Error("caller not matching BLOCKED_NUMBERS is blocked")
+	}
+}
+
+func TestIsForwardedRegion(t *testing.T) {
+	tests := []struct {
+		name   string
+		codes  string
+		caller string
+		want   bool
+	}{
+		{"match", "+1,+48", "+48221234567", true},
+		{"non-match", "+1,+48", "+442079460018", false},
+		{"empty list", "", "+442079460018", true},
+		// The Bahamas is part of the North American Numbering Plan, so
+		// shares +1, and +1242 is only an area code within it
+		{"+1 includes +1242", "+1", "+12425550100", true},
+		{"+1 outside the Bahamas", "+1", "+14155552671", true},
+		{"+44 doesn't match +1", "+44", "+12425550100", false},
+		{"unknown caller", "+1", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("FORWARD_COUNTRY_CODES", tt.codes)
+			if got := isForwardedRegion(testConfig(t), tt.caller); got != tt.want {
+				t.Errorf("isForwardedRegion(%q) with %q = %t, want %t", tt.caller, tt.codes, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCountryCodes(t *testing.T) {
+	for _, value := range []string{"1", "+1242", "+0", "+1,44"} {
+		if _, err := parseCountryCodes(value); err == nil {
+			t.Errorf("parseCountryCodes(%q) returned no error", value)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/twilio/twilio-go/twiml"
+)
+
+// callLimiter caps how many new calls are handled at once, so that a burst of
+// calls can't exhaust memory or Twilio's API rate limits. A nil *callLimiter
+// allows any number.
+type callLimiter struct {
+	slots chan struct{}
+}
+
+// newCallLimiter returns a limiter which allows limit calls to be handled at
+// once, or nil, allowing any number, if limit is less than 1
+func newCallLimiter(limit int) *callLimiter {
+	if limit < 1 {
+		return nil
+	}
+	return &callLimiter{slots: make(chan struct{}, limit)}
+}
+
+// acquire takes a slot, if one is free, and reports whether it did. Each
+// successful acquire must be followed by a release.
+func (l *callLimiter) acquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release frees a slot taken by acquire
+func (l *callLimiter) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
+
+// limit is middleware which handles calls with next while there is a free
+// slot, and otherwise asks the caller to call back later, with
+// busyElements, without waiting for one
+func (l *callLimiter) limit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !l.acquire() {
+			twimlResult, err := twiml.Voice(busyElements())
+			if err != nil {
+				appError(w, fmt.Errorf("could not reject call. reason: %s", err))
+				return
+			}
+			callsTotal.WithLabelValues("busy").Inc()
+			requestLogger(r).Warn("Routing call", "decision", "busy", "caller", r.FormValue("From"))
+			w.Header().Add("Content-Type", "application/xml")
+			w.Write([]byte(twimlResult))
+			return
+		}
+		defer l.release()
+		next(w, r)
+	}
+}
+
+// busyElements returns the TwiML for callers who call while
+// MAX_CONCURRENT_CALLS calls are already being handled, which asks them, with
+// BUSY_MESSAGE, to call back later, and hangs up
+func busyElements() []twiml.Element {
+	message := getEnv("BUSY_MESSAGE", "Sorry, we are receiving a lot of calls right now. Please call back later. Goodbye.")
+	return []twiml.Element{
+		greetingElement(message),
+		&twiml.VoiceHangup{},
+	}
+}
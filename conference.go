@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	twilioAPI "github.com/twilio/twilio-go/rest/api/v2010"
+	"github.com/twilio/twilio-go/twiml"
+)
+
+// defaultConferenceHoldMusic is what callers hear while they wait for staff to
+// join their conference, unless CONFERENCE_HOLD_MUSIC is set
+const defaultConferenceHoldMusic = "https://com.twilio.music.classical.s3.amazonaws.com/BusyStrings.mp3"
+
+// conferenceAPI is the part of the Twilio API which finds the conferences that
+// callers are waiting in, and sends callers who have waited too long to
+// voicemail
+type conferenceAPI interface {
+	ListConference(params *twilioAPI.ListConferenceParams) ([]twilioAPI.ApiV2010Conference, error)
+	UpdateCall(sid string, params *twilioAPI.UpdateCallParams) (*twilioAPI.ApiV2010Call, error)
+}
+
+// validateConference checks that useQueue and useConference, from USE_QUEUE
+// and USE_CONFERENCE, aren't both true, as calls can't be both queued and
+// joined to a conference, and that CONFERENCE_MAX_PARTICIPANTS, if set, is
+// between 2 and 250, as Twilio allows
+func validateConference(useQueue, useConference bool) error {
+	if useQueue && useConference {
+		return errors.New("USE_QUEUE and USE_CONFERENCE can't both be true")
+	}
+	value := os.Getenv("CONFERENCE_MAX_PARTICIPANTS")
+	if value == "" {
+		return nil
+	}
+	if participants, err := strconv.Atoi(value); err != nil || participants < 2 || participants > 250 {
+		return fmt.Errorf("CONFERENCE_MAX_PARTICIPANTS must be a number between 2 and 250, not %q", value)
+	}
+	return nil
+}
+
+// callerConference returns the name of the conference which the call callSID
+// waits in, so that each caller has a conference of their own
+func callerConference(cfg config, callSID string) string {
+	return cfg.conferenceName + "-" + callSID
+}
+
+// conferenceElement returns the <Dial> verb which joins the conference name,
+// where waitURL, if set, is what is heard until it starts. Whether joining
+// starts the conference, and leaving it ends it, is up to whoever joins, but
+// the rest of its settings are the same for everyone: CONFERENCE_BEEP, whether
+// a beep is played as people join and leave, and CONFERENCE_MAX_PARTICIPANTS,
+// the most people who can join at once.
+func conferenceElement(cfg config, name, waitURL string, startOnEnter, endOnExit bool) *twiml.VoiceDial {
+	return &twiml.VoiceDial{
+		InnerElements: []twiml.Element{&twiml.VoiceConference{
+			Name:                   name,
+			WaitUrl:                waitURL,
+			Beep:                   strconv.FormatBool(cfg.conferenceBeep),
+			MaxParticipants:        os.Getenv("CONFERENCE_MAX_PARTICIPANTS"),
+			StartConferenceOnEnter: strconv.FormatBool(startOnEnter),
+			EndConferenceOnExit:    strconv.FormatBool(endOnExit),
+		}},
+	}
+}
+
+// conferenceWaitURL returns the URL of the TwiML which callers hear while they
+// wait for staff, until deadline, after which they are sent to voicemail for
+// reason. loop counts how many times it has been requested, so that each
+// request is distinct.
+func conferenceWaitURL(reason routingReason, deadline time.Time, loop int) string {
+	return publicURL("/conference-wait?" + url.Values{
+		"reason": {string(reason)},
+		"until":  {strconv.FormatInt(deadline.Unix(), 10)},
+		"loop":   {strconv.Itoa(loop)},
+	}.Encode())
+}
+
+// conferenceElements returns the TwiML which joins the call callSID to a
+// conference of its own, which waits for staff to join, and ends when the
+// caller hangs up. Until staff join, the caller hears CONFERENCE_HOLD_MUSIC
+// and, if nobody joins within CONFERENCE_WAIT_TIMEOUT, they are sent to
+// voicemail for reason, as they are if they can't join the conference.
+func conferenceElements(cfg config, callSID string, reason routingReason) []twiml.Element {
+	var waitURL string
+	if cfg.conferenceWaitTimeout > 0 {
+		waitURL = conferenceWaitURL(reason, clock().Add(cfg.conferenceWaitTimeout), 0)
+	}
+	dial := conferenceElement(cfg, callerConference(cfg, callSID), waitURL, false, true)
+	dial.Action = publicURL("/conference-status?" + url.Values{"reason": {string(reason)}}.Encode())
+	return append(holdElements(), dial)
+}
+
+// handleConferenceWait returns a handler which Twilio requests while a caller
+// waits for staff to join their conference. It plays CONFERENCE_HOLD_MUSIC,
+// then requests itself again, until the deadline in its URL, when the call is
+// redirected, with calls, to /conference-status, which sends it to voicemail.
+// As the deadline is only checked between plays, a short track keeps callers
+// waiting no longer than CONFERENCE_WAIT_TIMEOUT.
+func handleConferenceWait(calls conferenceAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		reason := routingReason(query.Get("reason"))
+		until, err := strconv.ParseInt(query.Get("until"), 10, 64)
+		if err != nil {
+			appError(w, badRequest(fmt.Errorf("could not play hold music. reason: %q is not a deadline", query.Get("until"))))
+			return
+		}
+		deadline := time.Unix(until, 0)
+		loop, _ := strconv.Atoi(query.Get("loop"))
+		logger := requestLogger(r).With("caller", r.FormValue("From"), "conference", r.FormValue("FriendlyName"))
+
+		elements := []twiml.Element{
+			&twiml.VoicePlay{Url: getEnv("CONFERENCE_HOLD_MUSIC", defaultConferenceHoldMusic)},
+			&twiml.VoiceRedirect{Url: conferenceWaitURL(reason, deadline, loop+1)},
+		}
+		if !clock().Before(deadline) {
+			status := requestOrigin(r) + "/conference-status?" + url.Values{"reason": {string(reason)}}.Encode()
+			timer := prometheus.NewTimer(twilioAPIDuration.WithLabelValues("update_call"))
+			_, err := calls.UpdateCall(r.FormValue("CallSid"), (&twilioAPI.UpdateCallParams{}).SetUrl(status))
+			timer.ObserveDuration()
+			if err != nil {
+				logger.Error("Could not send the caller to voicemail, so they are still waiting", "error", err)
+			} else {
+				logger.Info("No staff joined the conference in time, sending the caller to voicemail", "reason", reason)
+				elements = nil
+			}
+		}
+
+		twimlResult, err := twiml.Voice(elements)
+		if err != nil {
+			appError(w, fmt.Errorf("could not play hold music. reason: %s", err))
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/xml")
+		w.Write([]byte(twimlResult))
+	}
+}
+
+// handleConferenceStatus is requested by Twilio once a caller leaves their
+// conference, or is redirected from it by handleConferenceWait. If the
+// conference ended, the call is over. Otherwise, e.g., if nobody joined in
+// time, or the caller couldn't join, they are sent to voicemail, if limiter
+// allows it, so that they can still leave a message.
+func handleConferenceStatus(cfg config, limiter *rateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := r.FormValue("DialCallStatus")
+		logger := requestLogger(r).With("caller", r.FormValue("From"), "dial_call_status", status)
+
+		elements := []twiml.Element{&twiml.VoiceHangup{}}
+		if status != "completed" {
+			reason := routingReason(r.URL.Query().Get("reason"))
+			logger.Info("Conference call was not answered, sending it to voicemail", "reason", reason)
+			elements = limiter.voicemail(r.Context(), cfg, reason, r.FormValue("From"), r.FormValue("To"))
+		}
+
+		twimlResult, err := twiml.Voice(elements)
+		if err != nil {
+			appError(w, fmt.Errorf("could not handle the conference call ending. reason: %s", err))
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/xml")
+		w.Write([]byte(twimlResult))
+	}
+}
+
+// nextConference returns the name of the conference, named after
+// CONFERENCE_NAME, whose caller has waited longest for staff, or, if every
+// caller has been picked up, the longest-running conference, so that staff
+// can join a call together. If there is neither, it returns an empty string.
+func nextConference(conferences conferenceAPI, cfg config) (string, error) {
+	for _, status := range []string{"init", "in-progress"} {
+		timer := prometheus.NewTimer(twilioAPIDuration.WithLabelValues("list_conferences"))
+		found, err := conferences.ListConference((&twilioAPI.ListConferenceParams{}).SetStatus(status))
+		timer.ObserveDuration()
+		if err != nil {
+			return "", fmt.Errorf("could not list conferences. reason: %s", err)
+		}
+
+		var name string
+		var oldest time.Time
+		for _, conference := range found {
+			if conference.FriendlyName == nil || !strings.HasPrefix(*conference.FriendlyName, cfg.conferenceName+"-") {
+				continue
+			}
+			var created time.Time
+			if conference.DateCreated != nil {
+				created, _ = time.Parse(time.RFC1123Z, *conference.DateCreated)
+			}
+			if name == "" || created.Before(oldest) {
+				name, oldest = *conference.FriendlyName, created
+			}
+		}
+		if name != "" {
+			return name, nil
+		}
+	}
+	return "", nil
+}
+
+// handleJoinConference returns a handler which joins staff, calling from one
+// of the forward numbers of the office that they called, to the conference of
+// the caller who has waited longest, which starts as soon as they join, and
+// carries on as they come and go. If nobody is waiting, they join the call
+// which started first, and, if there isn't one, they are told so. Calls from
+// any other number are rejected, so that only staff can join callers.
+func handleJoinConference(conferences conferenceAPI, cfg config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := cfg.forCalled(r.FormValue("To"))
+		caller := r.FormValue("From")
+		if normalized, err := normalizeNumber(caller); err == nil {
+			caller = normalized
+		}
+		logger := requestLogger(r).With("caller", caller)
+
+		elements := []twiml.Element{&twiml.VoiceReject{}}
+		if isStaff(cfg, caller) {
+			name, err := nextConference(conferences, cfg)
+			if err != nil {
+				appError(w, fmt.Errorf("could not find a conference to join. reason: %s", err))
+				return
+			}
+			if name != "" {
+				elements = []twiml.Element{conferenceElement(cfg, name, "", true, false)}
+				logger.Info("Joining staff to the conference", "conference", name)
+			} else {
+				elements = []twiml.Element{sayElement(getEnv("CONFERENCE_EMPTY_MESSAGE", "No callers are waiting.")), &twiml.VoiceHangup{}}
+				logger.Info("No callers are waiting in a conference")
+			}
+		} else {
+			logger.Warn("Rejecting conference call from a number which isn't one of the forward numbers")
+		}
+
+		twimlResult, err := twiml.Voice(elements)
+		if err != nil {
+			appError(w, fmt.Errorf("could not join the conference. reason: %s", err))
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/xml")
+		w.Write([]byte(twimlResult))
+	}
+}
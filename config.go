@@ -0,0 +1,513 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config holds the settings which are read from the environment once, at
+// startup, so that invalid values stop the application from starting, rather
+// than failing calls
+type config struct {
+	twilioAccountSID string
+	twilioAuthToken  string
+	// twilioPhoneNumber is the Twilio number which SMS are sent from
+	twilioPhoneNumber string
+	// callerID is the number which forwarded calls show, from CALLER_ID, or
+	// empty to show the caller's own number
+	callerID string
+
+	addr            string
+	databasePath    string
+	shutdownTimeout time.Duration
+	// validateCredentialsOnStart is whether the Twilio credentials are checked
+	// before serving, and dryRun whether SMS are logged, rather than sent
+	validateCredentialsOnStart bool
+	dryRun                     bool
+
+	// apiTimeout is how long to wait for Twilio's API, including retries
+	apiTimeout time.Duration
+	retry      retryPolicy
+
+	location      *time.Location
+	workWeekStart time.Weekday
+	workWeekEnd   time.Weekday
+	closedDays    closedDays
+	workDayHours  openingHours
+	workHours     schedule
+	holidays      holidays
+	openDates     openDates
+
+	// vacationStart and vacationEnd, if set, are when the whole office is
+	// away, and every call goes to voicemail
+	vacationStart time.Time
+	vacationEnd   time.Time
+
+	forwardNumbers []string
+	forwardWindows []forwardWindow
+	notifyNumbers  []string
+	notifySMS      bool
+	includeReason  bool
+
+	// ringStrategy is whether, when there is more than one forward number,
+	// they ring in turn, or all at once. dialTimeout is how many seconds
+	// forwarded calls ring for, and forwardNumberTimeout how many each number
+	// rings for when they ring in turn.
+	ringStrategy         string
+	dialTimeout          int
+	forwardNumberTimeout int
+	// recordForwardedCalls is whether answered forwarded calls are recorded
+	recordForwardedCalls bool
+	// screenCallers is whether callers must press a key, within
+	// screeningTimeout seconds, before their call is forwarded, so that
+	// robocalls don't reach staff
+	screenCallers    bool
+	screeningTimeout int
+
+	// menuTimeout is how many seconds callers have to press a key, in the IVR
+	// menu and other prompts
+	menuTimeout int
+
+	// useQueue is whether calls during business hours are placed in the call
+	// queue queueName, for staff to answer from /dequeue, rather than being
+	// forwarded
+	useQueue  bool
+	queueName string
+
+	// blockedNumbers are the callers whose calls are rejected, after hearing
+	// blockedMessage, if it is set. If allowedNumbers is set, only callers
+	// matching it may have their call forwarded, as may, if
+	// forwardCountryCodes is set, only callers with one of its calling codes.
+	blockedNumbers      []string
+	blockedMessage      string
+	allowedNumbers      []string
+	forwardCountryCodes []string
+
+	// onCallRotation, if set, are the numbers which take turns being on call
+	// after hours, changing every week from onCallRotationStart. Otherwise,
+	// after-hours calls are forwarded to afterHoursForward, if it is set.
+	onCallRotation      []string
+	onCallRotationStart time.Time
+	afterHoursForward   string
+
+	// recordingMaxLength is the most seconds a voicemail may last, and
+	// recordingTimeout the seconds of silence after which it ends, as it does
+	// when the caller presses one of recordingFinishKey
+	recordingMaxLength   int
+	recordingTimeout     int
+	recordingFinishKey   string
+	recordingPlayBeep    bool
+	recordingTrimSilence bool
+	// recordingMaxAttempts is how many times callers may record their
+	// voicemail, recordingPrompt, if set, tells them when to start speaking,
+	// and closingMessage, if set, is played once they have finished
+	recordingMaxAttempts int
+	recordingPrompt      string
+	closingMessage       string
+
+	// transcribeCallbackPath is the route which voicemails are sent to, once
+	// transcriber, set with transcribeProvider, has had them transcribed
+	transcribeCallbackPath string
+	transcribeProvider     string
+	transcriber            transcriber
+
+	// notifyOnRecording is whether, with NOTIFY_ON_RECORDING, staff are
+	// notified as soon as a voicemail is recorded, before Twilio has
+	// transcribed it. It only applies to voicemails which Twilio transcribes,
+	// as the others are already sent on once recorded, or transcribed by
+	// TRANSCRIBE_PROVIDER, and not when callers may record their voicemail
+	// again, as the recording may yet be discarded.
+	notifyOnRecording bool
+
+	// disableSignatureValidation lets requests without a valid
+	// X-Twilio-Signature through, for local testing
+	disableSignatureValidation bool
+
+	// useConference is whether calls are joined to a conference of their own,
+	// named after conferenceName, which staff join, rather than being
+	// forwarded, and conferenceWaitTimeout is how long callers wait for staff
+	// before being sent to voicemail, or 0 to wait until they hang up
+	useConference         bool
+	conferenceName        string
+	conferenceWaitTimeout time.Duration
+	// conferenceBeep is whether a beep is played as people join or leave
+	conferenceBeep bool
+
+	// smsMaxTranscriptionLength is the most characters of each transcription
+	// which are sent by SMS, or 0 for no limit
+	smsMaxTranscriptionLength int
+
+	// notifyLocation and notifyTimeLayout are the timezone and layout in which
+	// notifications show when each voicemail was received
+	notifyLocation   *time.Location
+	notifyTimeLayout string
+
+	callerNameLookup   bool
+	callerNameCacheTTL time.Duration
+
+	// voicemailRateLimit is how many voicemails each caller may leave within
+	// voicemailRateWindow, or 0 for no limit
+	voicemailRateLimit  int
+	voicemailRateWindow time.Duration
+
+	// maxConcurrentCalls is how many new calls may be handled at once, or 0 for
+	// no limit
+	maxConcurrentCalls int
+
+	// replayWindow is how long Twilio requests are remembered, to reject
+	// replays, or 0 to not check for them
+	replayWindow time.Duration
+
+	// callbackDedupWindow is how long voicemail callbacks are remembered, to
+	// acknowledge Twilio's retries without notifying anyone again, or 0 to
+	// handle every callback
+	callbackDedupWindow time.Duration
+
+	// offices are the configurations of each office, from OFFICES_JSON, keyed
+	// by the Twilio number that its callers call
+	offices map[string]config
+}
+
+// businessHours reports whether now is within the configured business hours
+// and, if not, why
+func (cfg config) businessHours(now time.Time) (bool, routingReason) {
+	if cfg.onVacation(now) {
+		return false, reasonVacation
+	}
+	return isDuringBusinessHours(now, cfg.holidays, cfg.openDates, cfg.closedDays, cfg.workHours, cfg.workWeekStart, cfg.workWeekEnd, cfg.workDayHours)
+}
+
+// onVacation reports whether now is within the vacation, which includes its
+// start, but not its end
+func (cfg config) onVacation(now time.Time) bool {
+	return !cfg.vacationStart.IsZero() && !now.Before(cfg.vacationStart) && now.Before(cfg.vacationEnd)
+}
+
+// twilioPhoneNumberRequired returns why TWILIO_PHONE_NUMBER must be set, given
+// whether notifySMS is, e.g., ", as the number that SMS notifications are
+// sent from", or an empty string if it needn't be
+func twilioPhoneNumberRequired(notifySMS bool) string {
+	switch {
+	case notifySMS:
+		return ", as the number that SMS notifications are sent from"
+	case callbackKey() != "":
+		return " when MENU_CALLBACK_KEY is, as the number that callback requests are sent from"
+	default:
+		return ""
+	}
+}
+
+// loadConfig reads the configuration from the environment, applying the
+// defaults documented in .env.example. Phone numbers are converted to E.164
+// format, so that they can be written however is convenient, e.g., (415)
+// 555-2671. Numbers which calls are only forwarded to may also be SIP URIs
+// but, since SIP URIs can't receive SMS messages, if MY_PHONE_NUMBER is one
+// then NOTIFY_NUMBERS must be set.
+func loadConfig() (config, error) {
+	var cfg config
+	var err error
+
+	if err := validateDefaultRegion(); err != nil {
+		return cfg, err
+	}
+	myPhoneNumber, err := normalizeEnv("MY_PHONE_NUMBER", normalizeForwardTarget)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.twilioAccountSID = os.Getenv("TWILIO_ACCOUNT_SID")
+	cfg.twilioAuthToken = os.Getenv("TWILIO_AUTH_TOKEN")
+	if cfg.twilioPhoneNumber, err = normalizeEnv("TWILIO_PHONE_NUMBER", normalizeNumber); err != nil {
+		return cfg, err
+	}
+	if cfg.callerID, err = normalizeEnv("CALLER_ID", normalizeNumber); err != nil {
+		return cfg, err
+	}
+
+	port := getEnv("PORT", "8080")
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return cfg, fmt.Errorf("PORT must be a number between 0 and 65535, not %q", port)
+	}
+	cfg.addr = net.JoinHostPort(getEnv("HOST", ""), port)
+	cfg.databasePath = getEnv("DATABASE_PATH", "voicemails.db")
+
+	if err := validatePublicBaseURL(); err != nil {
+		return cfg, err
+	}
+	if cfg.useQueue, err = getEnvBool("USE_QUEUE", false); err != nil {
+		return cfg, err
+	}
+	if cfg.queueName = getEnv("QUEUE_NAME", "support"); cfg.queueName == "" {
+		return cfg, fmt.Errorf("QUEUE_NAME must not be empty")
+	}
+	if cfg.useConference, err = getEnvBool("USE_CONFERENCE", false); err != nil {
+		return cfg, err
+	}
+	if err := validateConference(cfg.useQueue, cfg.useConference); err != nil {
+		return cfg, err
+	}
+	if cfg.conferenceName = getEnv("CONFERENCE_NAME", "support"); cfg.conferenceName == "" {
+		return cfg, fmt.Errorf("CONFERENCE_NAME must not be empty")
+	}
+	if cfg.conferenceWaitTimeout, err = getEnvDuration("CONFERENCE_WAIT_TIMEOUT", time.Minute, 0); err != nil {
+		return cfg, err
+	}
+	if cfg.conferenceBeep, err = getEnvBool("CONFERENCE_BEEP", true); err != nil {
+		return cfg, err
+	}
+	if cfg.ringStrategy, err = parseRingStrategy(getEnv("RING_STRATEGY", ringSequential)); err != nil {
+		return cfg, err
+	}
+	if cfg.dialTimeout, err = getEnvInt("DIAL_TIMEOUT", 30, 1); err != nil {
+		return cfg, err
+	}
+	if cfg.forwardNumberTimeout, err = getEnvInt("FORWARD_NUMBER_TIMEOUT", 20, 1); err != nil {
+		return cfg, err
+	}
+	if cfg.recordForwardedCalls, err = getEnvBool("RECORD_FORWARDED_CALLS", false); err != nil {
+		return cfg, err
+	}
+	if cfg.menuTimeout, err = getEnvInt("MENU_TIMEOUT", 5, 1); err != nil {
+		return cfg, err
+	}
+	if cfg.disableSignatureValidation, err = getEnvBool("DISABLE_SIGNATURE_VALIDATION", false); err != nil {
+		return cfg, err
+	}
+	if cfg.validateCredentialsOnStart, err = getEnvBool("VALIDATE_CREDENTIALS_ON_START", false); err != nil {
+		return cfg, err
+	}
+	if cfg.dryRun, err = getEnvBool("DRY_RUN", false); err != nil {
+		return cfg, err
+	}
+
+	if cfg.shutdownTimeout, err = getEnvDuration("SHUTDOWN_TIMEOUT", 10*time.Second, 0); err != nil {
+		return cfg, err
+	}
+	if cfg.apiTimeout, err = getEnvDuration("TWILIO_API_TIMEOUT", 10*time.Second, 0); err != nil {
+		return cfg, err
+	}
+
+	retryAttempts, err := getEnvInt("SMS_RETRY_MAX_ATTEMPTS", 3, 1)
+	if err != nil {
+		return cfg, err
+	}
+	retryDelay, err := getEnvDuration("SMS_RETRY_BASE_DELAY", 500*time.Millisecond, 0)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.retry = retryPolicy{maxAttempts: retryAttempts, baseDelay: retryDelay}
+
+	cfg.location = loadLocation(getEnv("WORK_TIMEZONE", "UTC"))
+	if cfg.workWeekStart, err = parseWeekday(getEnv("WORK_WEEK_START", "Monday")); err != nil {
+		return cfg, fmt.Errorf("invalid WORK_WEEK_START: %s", err)
+	}
+	if cfg.workWeekEnd, err = parseWeekday(getEnv("WORK_WEEK_END", "Friday")); err != nil {
+		return cfg, fmt.Errorf("invalid WORK_WEEK_END: %s", err)
+	}
+	if cfg.closedDays, err = parseClosedDays(splitList(os.Getenv("CLOSED_DAYS"))); err != nil {
+		return cfg, fmt.Errorf("invalid CLOSED_DAYS: %s", err)
+	}
+	if cfg.workDayHours, err = loadWorkDayHours(); err != nil {
+		return cfg, fmt.Errorf("could not parse business hours: %s", err)
+	}
+	if value := os.Getenv("WORK_HOURS_JSON"); value != "" {
+		if cfg.workHours, err = parseSchedule(value); err != nil {
+			return cfg, fmt.Errorf("could not parse WORK_HOURS_JSON: %s", err)
+		}
+	}
+	if cfg.holidays, err = loadHolidays(); err != nil {
+		return cfg, fmt.Errorf("could not load holidays: %s", err)
+	}
+	if value := os.Getenv("OPEN_DATES"); value != "" {
+		if cfg.openDates, err = parseOpenDates(value); err != nil {
+			return cfg, fmt.Errorf("could not parse OPEN_DATES: %s", err)
+		}
+	}
+
+	if cfg.vacationStart, err = parseDateFilter(os.Getenv("VACATION_START"), cfg.location, false); err != nil {
+		return cfg, fmt.Errorf("invalid VACATION_START: %s", err)
+	}
+	if cfg.vacationEnd, err = parseDateFilter(os.Getenv("VACATION_END"), cfg.location, true); err != nil {
+		return cfg, fmt.Errorf("invalid VACATION_END: %s", err)
+	}
+	if cfg.vacationStart.IsZero() != cfg.vacationEnd.IsZero() {
+		return cfg, fmt.Errorf("set both VACATION_START and VACATION_END, or neither")
+	}
+	if !cfg.vacationStart.IsZero() && !cfg.vacationEnd.After(cfg.vacationStart) {
+		return cfg, fmt.Errorf("VACATION_END must be after VACATION_START")
+	}
+
+	if cfg.forwardNumbers, err = normalizeEnvList("FORWARD_NUMBERS", normalizeForwardTarget); err != nil {
+		return cfg, err
+	}
+	if identity := os.Getenv("FORWARD_CLIENT"); identity != "" {
+		if len(cfg.forwardNumbers) > 0 {
+			return cfg, fmt.Errorf("set either FORWARD_NUMBERS or FORWARD_CLIENT, not both")
+		}
+		if !clientIdentityPattern.MatchString(identity) {
+			return cfg, fmt.Errorf("FORWARD_CLIENT must be a Twilio Client identity, e.g., reception, not %q", identity)
+		}
+		cfg.forwardNumbers = []string{clientPrefix + identity}
+	}
+	if len(cfg.forwardNumbers) == 0 {
+		cfg.forwardNumbers = []string{myPhoneNumber}
+	}
+	if value := os.Getenv("FORWARD_SCHEDULE"); value != "" {
+		if cfg.forwardWindows, err = parseForwardSchedule(value); err != nil {
+			return cfg, fmt.Errorf("could not parse FORWARD_SCHEDULE: %s", err)
+		}
+	}
+	if cfg.screenCallers, err = getEnvBool("SCREEN_CALLERS", false); err != nil {
+		return cfg, err
+	}
+	if cfg.screeningTimeout, err = getEnvInt("SCREENING_TIMEOUT", 5, 1); err != nil {
+		return cfg, err
+	}
+	cfg.blockedNumbers = splitList(os.Getenv("BLOCKED_NUMBERS"))
+	cfg.blockedMessage = os.Getenv("BLOCKED_MESSAGE")
+	cfg.allowedNumbers = splitList(os.Getenv("ALLOWED_NUMBERS"))
+	if cfg.forwardCountryCodes, err = parseCountryCodes(os.Getenv("FORWARD_COUNTRY_CODES")); err != nil {
+		return cfg, err
+	}
+
+	if cfg.onCallRotation, err = normalizeEnvList("ON_CALL_ROTATION", normalizeForwardTarget); err != nil {
+		return cfg, err
+	}
+	if cfg.onCallRotationStart, err = time.Parse("2006-01-02", getEnv("ON_CALL_ROTATION_START", "2024-01-01")); err != nil {
+		return cfg, fmt.Errorf("ON_CALL_ROTATION_START must be a date in YYYY-MM-DD format, not %q", os.Getenv("ON_CALL_ROTATION_START"))
+	}
+	if cfg.afterHoursForward, err = normalizeEnv("AFTER_HOURS_FORWARD", normalizeForwardTarget); err != nil {
+		return cfg, err
+	}
+
+	if cfg.recordingMaxLength, err = getEnvInt("RECORDING_MAX_LENGTH", 300, 1); err != nil {
+		return cfg, err
+	}
+	if cfg.recordingTimeout, err = getEnvInt("RECORDING_TIMEOUT", 10, 1); err != nil {
+		return cfg, err
+	}
+	if cfg.recordingFinishKey = getEnv("RECORDING_FINISH_KEY", "#"); cfg.recordingFinishKey == "" || strings.Trim(cfg.recordingFinishKey, "0123456789#*") != "" {
+		return cfg, fmt.Errorf("RECORDING_FINISH_KEY must only contain digits, # or *, not %q", cfg.recordingFinishKey)
+	}
+	if cfg.recordingPlayBeep, err = getEnvBool("RECORDING_PLAY_BEEP", true); err != nil {
+		return cfg, err
+	}
+	if cfg.recordingTrimSilence, err = getEnvBool("RECORDING_TRIM_SILENCE", true); err != nil {
+		return cfg, err
+	}
+	if cfg.recordingMaxAttempts, err = getEnvInt("RECORDING_MAX_ATTEMPTS", 1, 1); err != nil {
+		return cfg, err
+	}
+	cfg.recordingPrompt = os.Getenv("RECORDING_PROMPT")
+	cfg.closingMessage = os.Getenv("CLOSING_MESSAGE")
+
+	if cfg.transcribeCallbackPath = getEnv("TRANSCRIBE_CALLBACK_PATH", "/sms"); !strings.HasPrefix(cfg.transcribeCallbackPath, "/") {
+		return cfg, fmt.Errorf("TRANSCRIBE_CALLBACK_PATH must start with a /, not %q", cfg.transcribeCallbackPath)
+	}
+	cfg.transcribeProvider = getEnv("TRANSCRIBE_PROVIDER", transcribeProviderTwilio)
+	if err := validateTranscribeLanguage(cfg.transcribeProvider); err != nil {
+		return cfg, err
+	}
+	if cfg.notifyOnRecording, err = getEnvBool("NOTIFY_ON_RECORDING", false); err != nil {
+		return cfg, err
+	}
+	cfg.notifyOnRecording = cfg.notifyOnRecording && cfg.transcribeProvider == transcribeProviderTwilio && canTranscribe() && cfg.recordingMaxAttempts == 1
+	if cfg.transcriber, err = newTranscriber(cfg); err != nil {
+		return cfg, err
+	}
+
+	if cfg.notifyNumbers, err = normalizeEnvList("NOTIFY_NUMBERS", normalizeNumber); err != nil {
+		return cfg, err
+	}
+	if len(cfg.notifyNumbers) == 0 {
+		if isSIPURI(myPhoneNumber) {
+			return cfg, fmt.Errorf("NOTIFY_NUMBERS must be set when MY_PHONE_NUMBER is a SIP URI, as SMS notifications can't be sent to SIP URIs")
+		}
+		cfg.notifyNumbers = []string{myPhoneNumber}
+	}
+	if cfg.notifySMS, err = getEnvBool("NOTIFY_SMS", true); err != nil {
+		return cfg, err
+	}
+	if why := twilioPhoneNumberRequired(cfg.notifySMS); why != "" && cfg.twilioPhoneNumber == "" {
+		return cfg, fmt.Errorf("TWILIO_PHONE_NUMBER must be set%s", why)
+	}
+	if cfg.smsMaxTranscriptionLength, err = getEnvInt("SMS_MAX_TRANSCRIPTION_LENGTH", 0, 0); err != nil {
+		return cfg, err
+	}
+	cfg.notifyLocation = loadLocation(getEnv("NOTIFY_TIMEZONE", cfg.location.String()))
+	if cfg.notifyTimeLayout = getEnv("NOTIFY_TIME_FORMAT", defaultNotifyTimeLayout); cfg.notifyTimeLayout == "" {
+		return cfg, fmt.Errorf("NOTIFY_TIME_FORMAT must not be empty")
+	}
+	if cfg.includeReason, err = getEnvBool("NOTIFY_INCLUDE_REASON", false); err != nil {
+		return cfg, err
+	}
+
+	if cfg.callerNameLookup, err = getEnvBool("CALLER_NAME_LOOKUP", false); err != nil {
+		return cfg, err
+	}
+	if cfg.callerNameCacheTTL, err = getEnvDuration("CALLER_NAME_CACHE_TTL", time.Hour, 0); err != nil {
+		return cfg, err
+	}
+
+	if cfg.voicemailRateLimit, err = getEnvInt("VOICEMAIL_RATE_LIMIT", 0, 0); err != nil {
+		return cfg, err
+	}
+	if cfg.voicemailRateWindow, err = getEnvDuration("VOICEMAIL_RATE_WINDOW", time.Hour, time.Second); err != nil {
+		return cfg, err
+	}
+
+	if cfg.maxConcurrentCalls, err = getEnvInt("MAX_CONCURRENT_CALLS", 0, 0); err != nil {
+		return cfg, err
+	}
+
+	if cfg.replayWindow, err = getEnvDuration("REPLAY_WINDOW", 0, 0); err != nil {
+		return cfg, err
+	}
+	if cfg.callbackDedupWindow, err = getEnvDuration("CALLBACK_DEDUP_WINDOW", time.Hour, 0); err != nil {
+		return cfg, err
+	}
+
+	// Offices are based on the rest of the configuration, so must come last
+	if value := os.Getenv("OFFICES_JSON"); value != "" {
+		if cfg.offices, err = parseOffices(value, cfg); err != nil {
+			return cfg, fmt.Errorf("could not parse OFFICES_JSON: %s", err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// loadWorkDayHours returns the opening hours of each work day, from the
+// comma-separated intervals in WORK_DAY_HOURS, if it is set, or from
+// WORK_DAY_START and WORK_DAY_END otherwise
+func loadWorkDayHours() (openingHours, error) {
+	if value := os.Getenv("WORK_DAY_HOURS"); value != "" {
+		return parseOpeningHours(value)
+	}
+
+	workDayStart, err := parseTimeOfDay(getEnv("WORK_DAY_START", "8"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid WORK_DAY_START: %s", err)
+	}
+	workDayEnd, err := parseTimeOfDay(getEnv("WORK_DAY_END", "18"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid WORK_DAY_END: %s", err)
+	}
+	return newOpeningHours(interval{start: workDayStart, end: workDayEnd})
+}
+
+// loadLocation loads the named IANA timezone, e.g., America/Chicago. If the
+// timezone cannot be loaded, a warning is logged and UTC is used instead.
+func loadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		slog.Warn("Could not load timezone, falling back to UTC", "timezone", name, "error", err)
+		return time.UTC
+	}
+	return loc
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maskNumber hides all but the last two digits of a phone number, e.g.,
+// +14155552671 becomes +*********71, so that it can be shown without
+// revealing staff's personal numbers. SIP URIs only have their user hidden,
+// and Twilio Client identities aren't hidden.
+func maskNumber(number string) string {
+	if isClientIdentity(number) {
+		return number
+	}
+	if isSIPURI(number) {
+		if _, host, ok := strings.Cut(number, "@"); ok {
+			return "sip:***@" + host
+		}
+		return "sip:***"
+	}
+	if len(number) <= 3 {
+		return strings.Repeat("*", len(number))
+	}
+	return number[:1] + strings.Repeat("*", len(number)-3) + number[len(number)-2:]
+}
+
+// maskNumbers masks each of numbers with maskNumber
+func maskNumbers(numbers []string) []string {
+	masked := make([]string, 0, len(numbers))
+	for _, number := range numbers {
+		masked = append(masked, maskNumber(number))
+	}
+	return masked
+}
+
+// sortedKeys returns the keys of set in order
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// hoursStrings formats opening hours as a list of HH:MM-HH:MM intervals
+func hoursStrings(hours openingHours) []string {
+	intervals := make([]string, 0, len(hours))
+	for _, i := range hours {
+		intervals = append(intervals, i.String())
+	}
+	return intervals
+}
+
+// effectiveConfig is the configuration as reported by /config. It leaves out
+// secrets, such as the auth token, and masks phone numbers.
+type effectiveConfig struct {
+	Addr                string              `json:"addr"`
+	Timezone            string              `json:"timezone"`
+	WorkWeekStart       string              `json:"work_week_start"`
+	WorkWeekEnd         string              `json:"work_week_end"`
+	ClosedDays          []string            `json:"closed_days,omitempty"`
+	WorkDayHours        []string            `json:"work_day_hours"`
+	WorkHours           map[string][]string `json:"work_hours,omitempty"`
+	Holidays            []string            `json:"holidays"`
+	OpenDates           map[string][]string `json:"open_dates,omitempty"`
+	VacationStart       string              `json:"vacation_start,omitempty"`
+	VacationEnd         string              `json:"vacation_end,omitempty"`
+	ForwardNumbers      []string            `json:"forward_numbers"`
+	ForwardSchedule     map[string][]string `json:"forward_schedule,omitempty"`
+	RingStrategy        string              `json:"ring_strategy"`
+	ScreenCallers       bool                `json:"screen_callers"`
+	UseConference       bool                `json:"use_conference"`
+	UseQueue            bool                `json:"use_queue"`
+	QueueName           string              `json:"queue_name,omitempty"`
+	NotifyNumbers       []string            `json:"notify_numbers"`
+	NotifySMS           bool                `json:"notify_sms"`
+	IncludeReason       bool                `json:"include_reason"`
+	NotifyTimezone      string              `json:"notify_timezone"`
+	NotifyTimeFormat    string              `json:"notify_time_format"`
+	CallerNameLookup    bool                `json:"caller_name_lookup"`
+	APITimeout          string              `json:"twilio_api_timeout"`
+	RetryMaxAttempts    int                 `json:"sms_retry_max_attempts"`
+	RetryBaseDelay      string              `json:"sms_retry_base_delay"`
+	SMSMaxTranscription int                 `json:"sms_max_transcription_length"`
+	TranscribeProvider  string              `json:"transcribe_provider"`
+	VoicemailRateLimit  int                 `json:"voicemail_rate_limit"`
+	VoicemailRateWindow string              `json:"voicemail_rate_window"`
+	ShutdownTimeout     string              `json:"shutdown_timeout"`
+	MaxConcurrentCalls  int                 `json:"max_concurrent_calls"`
+	ReplayWindow        string              `json:"replay_window"`
+	CallbackDedupWindow string              `json:"callback_dedup_window"`
+	// Offices are the effective configurations of each office, keyed by its
+	// Twilio number, which isn't masked, as it is the office's public number
+	Offices map[string]effectiveConfig `json:"offices,omitempty"`
+}
+
+// newEffectiveConfig summarizes cfg, with its defaults applied, for /config
+func newEffectiveConfig(cfg config) effectiveConfig {
+	effective := effectiveConfig{
+		Addr:                cfg.addr,
+		Timezone:            cfg.location.String(),
+		WorkWeekStart:       cfg.workWeekStart.String(),
+		WorkWeekEnd:         cfg.workWeekEnd.String(),
+		WorkDayHours:        hoursStrings(cfg.workDayHours),
+		Holidays:            append(sortedKeys(cfg.holidays.dates), sortedKeys(cfg.holidays.annual)...),
+		ForwardNumbers:      maskNumbers(cfg.forwardNumbers),
+		RingStrategy:        cfg.ringStrategy,
+		ScreenCallers:       cfg.screenCallers,
+		UseConference:       cfg.useConference,
+		UseQueue:            cfg.useQueue,
+		NotifyNumbers:       maskNumbers(cfg.notifyNumbers),
+		NotifySMS:           cfg.notifySMS,
+		IncludeReason:       cfg.includeReason,
+		NotifyTimezone:      cfg.notifyLocation.String(),
+		NotifyTimeFormat:    cfg.notifyTimeLayout,
+		CallerNameLookup:    cfg.callerNameLookup,
+		APITimeout:          cfg.apiTimeout.String(),
+		RetryMaxAttempts:    cfg.retry.maxAttempts,
+		RetryBaseDelay:      cfg.retry.baseDelay.String(),
+		SMSMaxTranscription: cfg.smsMaxTranscriptionLength,
+		TranscribeProvider:  cfg.transcribeProvider,
+		VoicemailRateLimit:  cfg.voicemailRateLimit,
+		VoicemailRateWindow: cfg.voicemailRateWindow.String(),
+		ShutdownTimeout:     cfg.shutdownTimeout.String(),
+		MaxConcurrentCalls:  cfg.maxConcurrentCalls,
+		ReplayWindow:        cfg.replayWindow.String(),
+		CallbackDedupWindow: cfg.callbackDedupWindow.String(),
+	}
+
+	if cfg.useQueue {
+		effective.QueueName = cfg.queueName
+	}
+	if !cfg.vacationStart.IsZero() {
+		effective.VacationStart = cfg.vacationStart.Format(time.RFC3339)
+		effective.VacationEnd = cfg.vacationEnd.Format(time.RFC3339)
+	}
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if cfg.closedDays[day] {
+			effective.ClosedDays = append(effective.ClosedDays, day.String())
+		}
+	}
+	if len(cfg.workHours) > 0 {
+		effective.WorkHours = map[string][]string{}
+		for day, hours := range cfg.workHours {
+			effective.WorkHours[day.String()] = hoursStrings(hours)
+		}
+	}
+	if len(cfg.openDates) > 0 {
+		effective.OpenDates = map[string][]string{}
+		for date, hours := range cfg.openDates {
+			effective.OpenDates[date] = hoursStrings(hours)
+		}
+	}
+	if len(cfg.forwardWindows) > 0 {
+		effective.ForwardSchedule = map[string][]string{}
+		for _, window := range cfg.forwardWindows {
+			effective.ForwardSchedule[window.hours.String()] = maskNumbers(window.numbers)
+		}
+	}
+	if len(cfg.offices) > 0 {
+		effective.Offices = map[string]effectiveConfig{}
+		for number, office := range cfg.offices {
+			effective.Offices[number] = newEffectiveConfig(office)
+		}
+	}
+
+	return effective
+}
+
+// handleConfig returns a handler which reports the effective configuration as
+// JSON, to confirm that the application received the intended settings
+func handleConfig(cfg config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newEffectiveConfig(cfg))
+	}
+}
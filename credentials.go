@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	twilioAPI "github.com/twilio/twilio-go/rest/api/v2010"
+)
+
+// accountFetcher fetches a Twilio account. It is satisfied by the Twilio REST
+// client's Api service.
+type accountFetcher interface {
+	FetchAccount(sid string) (*twilioAPI.ApiV2010Account, error)
+}
+
+// checkCredentials fetches the account accountSID, which is one of the
+// cheapest authenticated requests to Twilio, to confirm that the credentials
+// work before the first call arrives, rather than when the first SMS fails.
+// Suspended or closed accounts are also reported.
+func checkCredentials(fetcher accountFetcher, accountSID string) error {
+	timer := prometheus.NewTimer(twilioAPIDuration.WithLabelValues("fetch_account"))
+	account, err := fetcher.FetchAccount(accountSID)
+	timer.ObserveDuration()
+	if err != nil {
+		return fmt.Errorf("could not fetch Twilio account %s; check TWILIO_ACCOUNT_SID and TWILIO_AUTH_TOKEN. reason: %s", accountSID, err)
+	}
+	if account.Status != nil && *account.Status != "active" {
+		return fmt.Errorf("Twilio account %s is %s, not active", accountSID, *account.Status)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// callbackDeduper acknowledges Twilio callbacks which repeat one already
+// received for the same recording, or, without a RecordingSid, the same call,
+// such as Twilio's retries of a callback which timed out, without handling
+// them again, so that staff aren't notified of a voicemail twice. Callbacks
+// are remembered for window, in store, so that a retry is recognised by any
+// replica. A nil *callbackDeduper lets every callback through.
+type callbackDeduper struct {
+	window time.Duration
+	store  stateStore
+}
+
+// newCallbackDeduper returns a deduper which remembers callbacks for window,
+// or nil, letting every callback through, if window isn't positive
+func newCallbackDeduper(window time.Duration, store stateStore) *callbackDeduper {
+	if window <= 0 {
+		return nil
+	}
+	return &callbackDeduper{window: window, store: store}
+}
+
+// dedupeKey returns the key which a callback to r's route is remembered by,
+// or an empty string if it has neither a RecordingSid nor a CallSid
+func dedupeKey(r *http.Request) string {
+	id := r.FormValue("RecordingSid")
+	if id == "" {
+		id = r.FormValue("CallSid")
+	}
+	if id == "" {
+		return ""
+	}
+	return "callback:" + r.URL.Path + ":" + id
+}
+
+// firstSeen records key, and reports whether it hadn't already been seen
+// within the window. If store can't be reached, the error is logged and the
+// callback is treated as unseen, so that voicemails aren't dropped.
+func (d *callbackDeduper) firstSeen(ctx context.Context, key string) bool {
+	first, err := d.store.claim(ctx, key, d.window)
+	if err != nil {
+		contextLogger(ctx).Error("Could not check for a duplicate callback, handling it", "error", err)
+		return true
+	}
+	return first
+}
+
+// check is middleware which acknowledges, with a 200, callbacks which repeat
+// one seen within the window, rather than passing them on. It should wrap
+// handlers inside validateTwilioSignature, so that only callbacks from Twilio
+// are remembered, and outside replayGuard.check, which would otherwise reject
+// Twilio's retries with a 403.
+func (d *callbackDeduper) check(next http.HandlerFunc) http.HandlerFunc {
+	if d == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := dedupeKey(r)
+		if key != "" && !d.firstSeen(r.Context(), key) {
+			duplicateCallbacksTotal.WithLabelValues(r.URL.Path).Inc()
+			requestLogger(r).Info("Acknowledging duplicate Twilio callback without handling it again", "recording_sid", r.FormValue("RecordingSid"), "call_sid", r.FormValue("CallSid"))
+			acknowledgeCallback(w)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// countingHandler returns a handler which counts the requests it is sent
+func countingHandler(count *int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		*count++
+	}
+}
+
+func TestCallbackDeduperDuplicate(t *testing.T) {
+	start := time.Date(2024, time.June, 12, 10, 0, 0, 0, time.UTC)
+	pinClock(t, start)
+	var handled int
+	handler := newCallbackDeduper(time.Hour, newMemoryStore()).check(countingHandler(&handled))
+
+	first := httptest.NewRecorder()
+	handler(first, postForm("/sms", voicemailForm))
+	retry := httptest.NewRecorder()
+	handler(retry, postForm("/sms", voicemailForm))
+
+	if handled != 1 {
+		t.Errorf("handled the callback %d times, want once", handled)
+	}
+	if retry.Code != http.StatusOK || retry.Header().Get("Content-Type") != "application/xml" {
+		t.Errorf("got status %d, Content-Type %q, want the duplicate acknowledged with TwiML", retry.Code, retry.Header().Get("Content-Type"))
+	}
+
+	// Once the window has passed, the callback is handled again
+	pinClock(t, start.Add(time.Hour))
+	handler(httptest.NewRecorder(), postForm("/sms", voicemailForm))
+	if handled != 2 {
+		t.Errorf("handled the callback %d times after the window, want twice", handled)
+	}
+}
+
+func TestCallbackDeduperDistinct(t *testing.T) {
+	var handled int
+	handler := newCallbackDeduper(time.Hour, newMemoryStore()).check(countingHandler(&handled))
+
+	handler(httptest.NewRecorder(), postForm("/sms", url.Values{"RecordingSid": {"RE1"}, "CallSid": {"CA1"}}))
+	handler(httptest.NewRecorder(), postForm("/sms", url.Values{"RecordingSid": {"RE2"}, "CallSid": {"CA1"}}))
+	// The same recording's callback to another route isn't a duplicate
+	handler(httptest.NewRecorder(), postForm("/recording-status", url.Values{"RecordingSid": {"RE1"}, "CallSid": {"CA1"}}))
+	// Callbacks with neither a RecordingSid nor a CallSid are never duplicates
+	handler(httptest.NewRecorder(), postForm("/sms", url.Values{}))
+	handler(httptest.NewRecorder(), postForm("/sms", url.Values{}))
+
+	if handled != 5 {
+		t.Errorf("handled %d callbacks, want 5", handled)
+	}
+}
+
+func TestCallbackDeduperDisabled(t *testing.T) {
+	var handled int
+	for _, d := range []*callbackDeduper{nil, newCallbackDeduper(0, newMemoryStore())} {
+		handler := d.check(countingHandler(&handled))
+		handler(httptest.NewRecorder(), postForm("/sms", voicemailForm))
+		handler(httptest.NewRecorder(), postForm("/sms", voicemailForm))
+	}
+
+	if handled != 4 {
+		t.Errorf("handled %d callbacks, want every one of 4", handled)
+	}
+}
+
+func TestDedupeKey(t *testing.T) {
+	tests := []struct {
+		name string
+		form url.Values
+		want string
+	}{
+		{"recording", url.Values{"RecordingSid": {"RE1"}, "CallSid": {"CA1"}}, "callback:/sms:RE1"},
+		{"call", url.Values{"CallSid": {"CA1"}}, "callback:/sms:CA1"},
+		{"neither", url.Values{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dedupeKey(postForm("/sms", tt.form)); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log/slog"
+
+	twilioAPI "github.com/twilio/twilio-go/rest/api/v2010"
+)
+
+// dryRunSender is a messageSender which logs the SMS messages it would have
+// sent, instead of sending them, so that the application can be exercised
+// without a Twilio account or incurring charges
+type dryRunSender struct{}
+
+// CreateMessage logs the recipient, sender, and body of the message, and
+// reports it as queued
+func (dryRunSender) CreateMessage(params *twilioAPI.CreateMessageParams) (*twilioAPI.ApiV2010Message, error) {
+	slog.Info("Dry run, not sending SMS", "to", stringValue(params.To), "from", stringValue(params.From), "body", stringValue(params.Body))
+
+	sid := "SM00000000000000000000000000000000"
+	status := "queued"
+	return &twilioAPI.ApiV2010Message{Sid: &sid, Status: &status}, nil
+}
+
+// stringValue returns the string that s points to, or an empty string if s is
+// nil
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// emailNotifier sends voicemail notifications by email, over SMTP
+type emailNotifier struct {
+	host string
+	addr string
+	auth smtp.Auth
+	from string
+	to   []string
+	// timeout is how long sending each email may take, as for the other
+	// notifiers' API requests
+	timeout time.Duration
+}
+
+// newEmailNotifier returns an emailNotifier configured from NOTIFY_EMAIL,
+// SMTP_HOST, SMTP_PORT, SMTP_USER, and SMTP_PASS, which gives up on each email
+// after timeout, or nil if either NOTIFY_EMAIL or SMTP_HOST are not set
+func newEmailNotifier(timeout time.Duration) *emailNotifier {
+	to := os.Getenv("NOTIFY_EMAIL")
+	host := os.Getenv("SMTP_HOST")
+	if to == "" || host == "" {
+		return nil
+	}
+
+	notifier := &emailNotifier{
+		host:    host,
+		addr:    net.JoinHostPort(host, getEnv("SMTP_PORT", "587")),
+		from:    getEnv("SMTP_FROM", os.Getenv("SMTP_USER")),
+		timeout: timeout,
+	}
+	for _, address := range strings.Split(to, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			notifier.to = append(notifier.to, address)
+		}
+	}
+	if user := os.Getenv("SMTP_USER"); user != "" {
+		notifier.auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASS"), host)
+	}
+
+	return notifier
+}
+
+// channel returns "email"
+func (n *emailNotifier) channel() string { return "email" }
+
+// notify emails the details of the voicemail to each of the configured
+// recipients
+func (n *emailNotifier) notify(ctx context.Context, event voicemailEvent) error {
+	caller, transcription, recordingURL := event.Caller, event.Transcription, event.RecordingURL
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\n", n.from)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(n.to, ", "))
+	if caller != "" {
+		fmt.Fprintf(&body, "Subject: New voicemail from %s\r\n", caller)
+	} else {
+		fmt.Fprint(&body, "Subject: New voicemail\r\n")
+	}
+	fmt.Fprint(&body, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	if caller != "" {
+		fmt.Fprintf(&body, "Caller: %s\r\n", caller)
+	}
+	fmt.Fprintf(&body, "Received: %s\r\n", event.received())
+	if recordingURL != "" {
+		fmt.Fprintf(&body, "Recording: %s\r\n", recordingURL)
+	}
+	if event.CallSID != "" {
+		fmt.Fprintf(&body, "Call SID: %s\r\n", event.CallSID)
+	}
+	if event.TranscriptionPending {
+		transcription = "The transcription will follow."
+	}
+	fmt.Fprintf(&body, "\r\n%s\r\n", transcription)
+
+	return n.send(ctx, []byte(body.String()))
+}
+
+// send sends msg to each of the recipients, as smtp.SendMail does, but gives
+// up once ctx is done, or timeout passes, rather than waiting on an
+// unresponsive server
+func (n *emailNotifier) send(ctx context.Context, msg []byte) error {
+	if n.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, n.timeout)
+		defer cancel()
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", n.addr)
+	if err != nil {
+		return fmt.Errorf("could not connect to %s. reason: %s", n.addr, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Unblock the client if ctx is cancelled before its deadline
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	client, err := smtp.NewClient(conn, n.host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: n.host}); err != nil {
+			return err
+		}
+	}
+	if n.auth != nil {
+		if ok, _ := client.Extension("AUTH"); ok {
+			if err := client.Auth(n.auth); err != nil {
+				return err
+			}
+		}
+	}
+	if err := client.Mail(n.from); err != nil {
+		return err
+	}
+	for _, to := range n.to {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"os"
+)
+
+// flagEnvVars maps each command-line flag to the environment variable which it
+// overrides
+var flagEnvVars = []struct {
+	name, envVar, usage string
+}{
+	{"port", "PORT", "the port to listen on"},
+	{"host", "HOST", "the host to listen on"},
+	{"timezone", "WORK_TIMEZONE", "the timezone of the business hours, e.g., America/Chicago"},
+	{"forward-number", "FORWARD_NUMBERS", "the number, or comma-separated numbers, to forward calls to"},
+	{"work-start", "WORK_DAY_START", "when business hours start, as a whole hour or HH:MM"},
+	{"work-end", "WORK_DAY_END", "when business hours end, as a whole hour or HH:MM"},
+	{"work-week-start", "WORK_WEEK_START", "the first day of the work week, e.g., Monday"},
+	{"work-week-end", "WORK_WEEK_END", "the last day of the work week, e.g., Friday"},
+}
+
+// applyFlags parses args as command-line flags and sets the environment
+// variable of each flag that was passed, so that flags take precedence over
+// both the environment and .env, e.g., to try different business hours
+// without editing .env
+func applyFlags(args []string) error {
+	fs := flag.NewFlagSet("call-forwarding", flag.ContinueOnError)
+	values := make(map[string]*string, len(flagEnvVars))
+	for _, f := range flagEnvVars {
+		values[f.name] = fs.String(f.name, "", f.usage+"; overrides "+f.envVar)
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, mapping := range flagEnvVars {
+			if mapping.name == f.Name && err == nil {
+				err = os.Setenv(mapping.envVar, *values[f.Name])
+			}
+		}
+	})
+	return err
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/twilio/twilio-go/twiml"
+)
+
+// sipURIPattern matches SIP URIs which Twilio can dial, e.g.,
+// sip:reception@pbx.example.com, optionally followed by parameters such as
+// ;transport=tls
+var sipURIPattern = regexp.MustCompile(`^sip:[^@\s;]+@[A-Za-z0-9.-]+(:\d{1,5})?(;[^\s]*)?$`)
+
+// isSIPURI reports whether target is a SIP URI, rather than a phone number
+func isSIPURI(target string) bool {
+	return strings.HasPrefix(strings.ToLower(target), "sip:")
+}
+
+// clientIdentityPattern matches Twilio Client identities, which calls can be
+// forwarded to with FORWARD_CLIENT, e.g., reception or alice@example.com
+var clientIdentityPattern = regexp.MustCompile(`^[A-Za-z0-9_.@-]+$`)
+
+// clientPrefix marks forward targets which are Twilio Client identities,
+// rather than phone numbers or SIP URIs, as in the From of calls from them
+const clientPrefix = "client:"
+
+// isClientIdentity reports whether target is a Twilio Client identity
+func isClientIdentity(target string) bool {
+	return strings.HasPrefix(target, clientPrefix)
+}
+
+// validateForwardTarget checks that target, which calls are forwarded to, is
+// either a SIP URI or a phone number in E.164 format
+func validateForwardTarget(target string) error {
+	if !isSIPURI(target) {
+		return validateE164(target)
+	}
+	if !sipURIPattern.MatchString(target) {
+		return fmt.Errorf("%q is not a valid SIP URI; it must look like sip:user@host, e.g., sip:reception@pbx.example.com", target)
+	}
+	return nil
+}
+
+// forwardWindow is a period of the day during which calls are forwarded to
+// its own numbers, e.g., a department's morning team
+type forwardWindow struct {
+	hours   interval
+	numbers []string
+}
+
+// parseForwardSchedule parses a JSON object, keyed by HH:MM-HH:MM interval,
+// of comma-separated numbers, e.g.,
+// {"08:00-12:00": "+14155550100", "12:00-18:00": "+14155550101,+14155550102"},
+// into forward windows, in order of their start
+func parseForwardSchedule(value string) ([]forwardWindow, error) {
+	var entries map[string]string
+	if err := json.Unmarshal([]byte(value), &entries); err != nil {
+		return nil, err
+	}
+
+	intervals := make([]interval, 0, len(entries))
+	numbers := make(map[interval][]string, len(entries))
+	for key, list := range entries {
+		hours, err := parseOpeningHours(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(hours) != 1 {
+			return nil, fmt.Errorf("%q must be a single HH:MM-HH:MM interval", key)
+		}
+
+		normalized, err := normalizeList(list, normalizeForwardTarget)
+		if err == nil && len(normalized) == 0 {
+			err = errors.New("it has no numbers")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s is invalid: %s", key, err)
+		}
+
+		intervals = append(intervals, hours[0])
+		numbers[hours[0]] = normalized
+	}
+
+	sorted, err := newOpeningHours(intervals...)
+	if err != nil {
+		return nil, err
+	}
+	windows := make([]forwardWindow, 0, len(sorted))
+	for _, hours := range sorted {
+		windows = append(windows, forwardWindow{hours: hours, numbers: numbers[hours]})
+	}
+	return windows, nil
+}
+
+// forwardNumbersAt returns the numbers to forward calls to at now: those of the
+// forward window containing now, if any, or fallback otherwise. Windows include
+// their start, but not their end, so at 12:00 a call is forwarded to the window
+// starting at 12:00, not the one ending then.
+func forwardNumbersAt(now time.Time, windows []forwardWindow, fallback []string) []string {
+	minutes := minutesSinceMidnight(now)
+	for _, window := range windows {
+		if minutes >= window.hours.start.minutes() && minutes < window.hours.end.minutes() {
+			return window.numbers
+		}
+	}
+	return fallback
+}
+
+// ringSimultaneous and ringSequential are the values of RING_STRATEGY, which
+// decides whether, when there is more than one number to forward a call to,
+// they ring at once, or in turn
+const (
+	ringSimultaneous = "simultaneous"
+	ringSequential   = "sequential"
+)
+
+// parseRingStrategy checks that strategy, from RING_STRATEGY, is simultaneous
+// or sequential
+func parseRingStrategy(strategy string) (string, error) {
+	if strategy != ringSimultaneous && strategy != ringSequential {
+		return "", fmt.Errorf("RING_STRATEGY must be simultaneous or sequential, not %q", strategy)
+	}
+	return strategy, nil
+}
+
+// holdElements returns the TwiML played to the caller before their call is
+// forwarded, so that they know they haven't been cut off. By default, this is
+// a short message, which can be changed with HOLD_MESSAGE, or skipped by
+// setting HOLD_MESSAGE to an empty string.
+func holdElements() []twiml.Element {
+	message := getEnv("HOLD_MESSAGE", "Please hold while we connect you.")
+	if message == "" {
+		return nil
+	}
+	return []twiml.Element{sayElement(message)}
+}
+
+// dialElement returns the <Dial> verb which forwards the call from caller to
+// numbers. If there is more than one, they ring in turn, each for
+// FORWARD_NUMBER_TIMEOUT seconds, or, if strategy is simultaneous, all at
+// once, connecting whoever answers first. Otherwise, the number rings for
+// DIAL_TIMEOUT seconds, as do simultaneous numbers. If none of them answer,
+// Twilio requests /dial-status, which sends the caller to voicemail for
+// reason. If RECORD_FORWARDED_CALLS is true, answered calls are recorded in
+// dual-channel, with each party on its own channel. Forwarded calls show the
+// caller's number, unless CALLER_ID is set, in which case they show that
+// instead.
+func dialElement(cfg config, numbers []string, caller string, reason routingReason, strategy string) *twiml.VoiceDial {
+	dial := &twiml.VoiceDial{
+		Action:   publicURL("/dial-status?" + url.Values{"reason": {string(reason)}}.Encode()),
+		CallerId: cfg.callerID,
+		RingTone: os.Getenv("DIAL_RING_TONE"),
+		Timeout:  strconv.Itoa(cfg.dialTimeout),
+	}
+	if cfg.recordForwardedCalls {
+		dial.Record = "record-from-answer-dual"
+	}
+	if len(numbers) > 1 && strategy == ringSequential {
+		dial.Sequential = "true"
+		dial.Timeout = strconv.Itoa(cfg.forwardNumberTimeout)
+	}
+	for _, number := range numbers {
+		dial.InnerElements = append(dial.InnerElements, forwardNumberElement(number, caller))
+	}
+	return dial
+}
+
+// forwardElements returns the TwiML which forwards the call from caller to
+// numbers, which ring as strategy says, falling back to voicemail if none of
+// them answer
+func forwardElements(cfg config, numbers []string, caller, strategy string) []twiml.Element {
+	return append(holdElements(), dialElement(cfg, numbers, caller, reasonNoAnswer, strategy))
+}
+
+// onCallElements returns the TwiML which forwards an after-hours call from
+// caller to the on-call number, falling back to voicemail, for reason, if it
+// isn't answered
+func onCallElements(cfg config, number, caller string, reason routingReason) []twiml.Element {
+	return append(holdElements(), dialElement(cfg, []string{number}, caller, reason, ringSequential))
+}
+
+// handleDialStatus is requested by Twilio once a forwarded call ends. If the
+// caller was connected, the call is over and is hung up. Otherwise, e.g., if
+// the number was busy, didn't answer, or was answered by a machine and hung
+// up by handleMachineDetection, the caller is sent to voicemail, if limiter
+// allows it, so that they can still leave a message. If the call couldn't be
+// placed at all, the caller first hears DIAL_FAILED_MESSAGE, if set, as,
+// unlike a busy or unanswered number, nothing else tells them what happened.
+func handleDialStatus(cfg config, limiter *rateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := r.FormValue("DialCallStatus")
+		logger := requestLogger(r).With("caller", r.FormValue("From"), "dial_call_status", status)
+
+		elements := []twiml.Element{&twiml.VoiceHangup{}}
+		if status != "completed" || r.FormValue("DialBridged") == "false" {
+			reason := routingReason(r.URL.Query().Get("reason"))
+			logger.Info("Forwarded call was not answered, sending it to voicemail", "reason", reason)
+			elements = limiter.voicemail(r.Context(), cfg, reason, r.FormValue("From"), r.FormValue("To"))
+			if message := getEnv("DIAL_FAILED_MESSAGE", "Sorry, I was unable to redirect you."); status == "failed" && message != "" {
+				elements = append([]twiml.Element{sayElement(message)}, elements...)
+			}
+		}
+
+		twimlResult, err := twiml.Voice(elements)
+		if err != nil {
+			appError(w, fmt.Errorf("could not handle the forwarded call ending. reason: %s", err))
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/xml")
+		w.Write([]byte(twimlResult))
+	}
+}
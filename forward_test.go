@@ -0,0 +1,293 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/twilio/twilio-go/twiml"
+)
+
+// voiceXML renders elements as TwiML, failing the test if they can't be
+func voiceXML(t *testing.T, elements []twiml.Element) string {
+	t.Helper()
+	document, err := twiml.Voice(elements)
+	if err != nil {
+		t.Fatalf("twiml.Voice returned %v", err)
+	}
+	return document
+}
+
+func TestForwardElementsHoldMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		message *string
+		want    string
+	}{
+		{name: "default", want: "<Say>Please hold while we connect you.</Say>"},
+		{name: "custom", message: ptr("One moment, please."), want: "<Say>One moment, please.</Say>"},
+		{name: "skipped", message: ptr("")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unsetenv(t, "HOLD_MESSAGE")
+			if tt.message != nil {
+				t.Setenv("HOLD_MESSAGE", *tt.message)
+			}
+
+			document := voiceXML(t, forwardElements(testConfig(t), []string{"+14155550100"}, "+14155552671", ringSequential))
+			say, dial := strings.Index(document, "<Say"), strings.Index(document, "<Dial")
+			if dial < 0 {
+				t.Fatalf("TwiML has no <Dial>: %s", document)
+			}
+			if tt.want == "" {
+				if say >= 0 {
+					t.Errorf("TwiML has a <Say>, want none: %s", document)
+				}
+				return
+			}
+			if !strings.Contains(document, tt.want) || say > dial {
+				t.Errorf("TwiML doesn't have %s before the <Dial>: %s", tt.want, document)
+			}
+		})
+	}
+}
+
+// ptr returns a pointer to value
+func ptr(value string) *string {
+	return &value
+}
+
+func TestValidateForwardTarget(t *testing.T) {
+	tests := []struct {
+		target  string
+		wantErr bool
+	}{
+		{target: "+14155550100"},
+		{target: "sip:reception@pbx.example.com"},
+		{target: "sip:reception@pbx.example.com:5060;transport=tls"},
+		{target: "sip:pbx.example.com", wantErr: true},
+		{target: "sip:reception@", wantErr: true},
+		{target: "4155550100", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateForwardTarget(tt.target); (err != nil) != tt.wantErr {
+			t.Errorf("validateForwardTarget(%q) returned %v, want error: %t", tt.target, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDialElementSIP(t *testing.T) {
+	unsetenv(t, "MACHINE_DETECTION")
+	unsetenv(t, "WHISPER_MESSAGE")
+
+	tests := []struct {
+		target      string
+		want        string
+		wantMissing string
+	}{
+		{"sip:reception@pbx.example.com", "<Sip>sip:reception@pbx.example.com</Sip>", "<Number"},
+		{"+14155550100", "<Number>+14155550100</Number>", "<Sip"},
+	}
+	for _, tt := range tests {
+		document := voiceXML(t, []twiml.Element{dialElement(testConfig(t), []string{tt.target}, "+14155552671", reasonNoAnswer, ringSequential)})
+		if !strings.Contains(document, tt.want) || strings.Contains(document, tt.wantMissing) {
+			t.Errorf("TwiML for %s doesn't dial it with %s: %s", tt.target, tt.want, document)
+		}
+	}
+}
+
+func TestDialElementMachineDetection(t *testing.T) {
+	t.Setenv("MACHINE_DETECTION", "Enable")
+	t.Setenv("MACHINE_DETECTION_TIMEOUT", "10")
+
+	for _, target := range []string{"sip:reception@pbx.example.com", "+14155550100"} {
+		document := voiceXML(t, []twiml.Element{dialElement(testConfig(t), []string{target}, "+14155552671", reasonNoAnswer, ringSequential)})
+		if !strings.Contains(document, `machineDetection="Enable"`) || !strings.Contains(document, `machineDetectionTimeout="10"`) {
+			t.Errorf("TwiML for %s doesn't enable machine detection: %s", target, document)
+		}
+	}
+}
+
+func TestDialElementRingStrategy(t *testing.T) {
+	t.Setenv("DIAL_TIMEOUT", "40")
+	t.Setenv("FORWARD_NUMBER_TIMEOUT", "15")
+
+	tests := []struct {
+		name           string
+		numbers        []string
+		strategy       string
+		wantSequential bool
+		wantTimeout    string
+	}{
+		{"sequential", []string{"+14155550100", "+14155550101"}, ringSequential, true, "15"},
+		{"simultaneous", []string{"+14155550100", "+14155550101"}, ringSimultaneous, false, "40"},
+		{"one number", []string{"+14155550100"}, ringSequential, false, "40"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			document := voiceXML(t, []twiml.Element{dialElement(testConfig(t), tt.numbers, "+14155552671", reasonNoAnswer, tt.strategy)})
+			if got := strings.Contains(document, `sequential="true"`); got != tt.wantSequential {
+				t.Errorf("got sequential %t, want %t: %s", got, tt.wantSequential, document)
+			}
+			if want := `timeout="` + tt.wantTimeout + `"`; !strings.Contains(document, want) {
+				t.Errorf("<Dial> doesn't have %s: %s", want, document)
+			}
+			// Sequential numbers ring in the order they're configured
+			last := -1
+			for _, number := range tt.numbers {
+				i := strings.Index(document, "<Number>"+number+"</Number>")
+				if i <= last {
+					t.Errorf("TwiML doesn't dial %s, after the numbers before it: %s", number, document)
+				}
+				last = i
+			}
+		})
+	}
+}
+
+func TestParseRingStrategy(t *testing.T) {
+	for _, strategy := range []string{ringSimultaneous, ringSequential} {
+		if got, err := parseRingStrategy(strategy); err != nil || got != strategy {
+			t.Errorf("parseRingStrategy(%q) returned %q, %v, want %[1]q, no error", strategy, got, err)
+		}
+	}
+	for _, strategy := range []string{"", "Sequential", "round-robin"} {
+		if _, err := parseRingStrategy(strategy); err == nil {
+			t.Errorf("parseRingStrategy(%q) returned no error", strategy)
+		}
+	}
+}
+
+func TestForwardNumbersAt(t *testing.T) {
+	windows, err := parseForwardSchedule(`{"08:00-12:00": "+14155550100", "12:00-18:00": "+14155550101,+14155550102"}`)
+	if err != nil {
+		t.Fatalf("parseForwardSchedule returned %v", err)
+	}
+	fallback := []string{"+14155550199"}
+
+	tests := []struct {
+		hour, minute int
+		want         []string
+	}{
+		{8, 0, []string{"+14155550100"}},
+		{11, 59, []string{"+14155550100"}},
+		{12, 0, []string{"+14155550101", "+14155550102"}},
+		{17, 59, []string{"+14155550101", "+14155550102"}},
+		{18, 0, fallback},
+		{7, 59, fallback},
+	}
+	for _, tt := range tests {
+		now := time.Date(2024, time.June, 12, tt.hour, tt.minute, 0, 0, time.UTC)
+		if got := forwardNumbersAt(now, windows, fallback); !slices.Equal(got, tt.want) {
+			t.Errorf("got %v at %02d:%02d, want %v", got, tt.hour, tt.minute, tt.want)
+		}
+	}
+}
+
+func TestParseForwardScheduleInvalid(t *testing.T) {
+	for _, value := range []string{
+		`{"08:00-12:00,13:00-18:00": "+14155550100"}`,
+		`{"08:00-12:00": ""}`,
+		`{"08:00-12:00": "not a number"}`,
+		`{"18:00-08:00": "+14155550100"}`,
+	} {
+		if _, err := parseForwardSchedule(value); err == nil {
+			t.Errorf("parseForwardSchedule(%s) returned no error", value)
+		}
+	}
+}
+
+func TestHandleDialStatus(t *testing.T) {
+	tests := []struct {
+		status      string
+		message     *string
+		want        []string
+		wantMissing []string
+	}{
+		{status: "completed", want: []string{"<Hangup"}, wantMissing: []string{"<Record", "unable to redirect"}},
+		{status: "no-answer", want: []string{"<Record"}, wantMissing: []string{"<Hangup", "unable to redirect"}},
+		{status: "busy", want: []string{"<Record"}, wantMissing: []string{"<Hangup", "unable to redirect"}},
+		{status: "busy", message: ptr("The line is busy."), want: []string{"<Record"}, wantMissing: []string{"The line is busy."}},
+		{status: "failed", want: []string{"Sorry, I was unable to redirect you.", "<Record"}, wantMissing: []string{"<Hangup"}},
+		{status: "failed", message: ptr("Forwarding failed."), want: []string{"Forwarding failed.", "<Record"}, wantMissing: []string{"unable to redirect"}},
+		{status: "failed", message: ptr(""), want: []string{"<Record"}, wantMissing: []string{"unable to redirect"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			setenvOrUnset(t, "DIAL_FAILED_MESSAGE", tt.message)
+			cfg := testConfig(t)
+
+			w := httptest.NewRecorder()
+			handleDialStatus(cfg, nil)(w, postForm("/dial-status?reason=no-answer", url.Values{"DialCallStatus": {tt.status}}))
+
+			body := w.Body.String()
+			for _, want := range tt.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("TwiML doesn't contain %s: %s", want, body)
+				}
+			}
+			for _, missing := range tt.wantMissing {
+				if strings.Contains(body, missing) {
+					t.Errorf("TwiML contains %s: %s", missing, body)
+				}
+			}
+		})
+	}
+}
+
+func TestDialElementCallerID(t *testing.T) {
+	tests := []struct {
+		name     string
+		callerID *string
+		want     string
+	}{
+		{name: "caller's number by default"},
+		{name: "Twilio number", callerID: ptr("+14155550199"), want: "+14155550199"},
+		{name: "Twilio number, formatted", callerID: ptr("(415) 555-0199"), want: "+14155550199"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenvOrUnset(t, "CALLER_ID", tt.callerID)
+			cfg := testConfig(t)
+
+			document := voiceXML(t, []twiml.Element{dialElement(cfg, []string{"+14155550100"}, "+14155552671", reasonNoAnswer, ringSequential)})
+			if tt.want == "" {
+				if strings.Contains(document, "callerId=") {
+					t.Errorf("<Dial> has a callerId, want the caller's number: %s", document)
+				}
+				return
+			}
+			if want := `callerId="` + tt.want + `"`; !strings.Contains(document, want) {
+				t.Errorf("<Dial> doesn't have %s: %s", want, document)
+			}
+		})
+	}
+}
+
+func TestHandleWhisper(t *testing.T) {
+	t.Setenv("WHISPER_MESSAGE", "Call from {caller}.")
+
+	tests := []struct {
+		name   string
+		caller string
+		want   string
+	}{
+		{"number", "+14155552671", "Call from 1 4 1 5 5 5 5 2 6 7 1."},
+		{"no number", "", "Call from an unknown number."},
+		{"withheld", "anonymous", "Call from an unknown number."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handleWhisper(w, postForm(forwardedLegURL(tt.caller), url.Values{}))
+
+			if body := w.Body.String(); !strings.Contains(body, tt.want) {
+				t.Errorf("whisper doesn't say %q: %s", tt.want, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// loggerKey is the context key under which the request-scoped logger is stored
+type loggerKey struct{}
+
+// newLogger returns a logger which writes JSON to stdout, at LOG_LEVEL, either
+// debug, info, warn, or error. It defaults to info, and debug adds the TwiML
+// returned to each call.
+func newLogger() *slog.Logger {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(getEnv("LOG_LEVEL", "info"))); err != nil {
+		slog.Warn("Invalid LOG_LEVEL, using info instead", "value", os.Getenv("LOG_LEVEL"))
+		level = slog.LevelInfo
+	}
+	return slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
+}
+
+// fatal logs msg, and any attributes, at error level, then exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// newRequestID returns a random, 16-byte, hex-encoded request ID
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// withRequestLogger is middleware which attaches a logger, tagged with a
+// request ID, to each request's context, so that events for a single call can
+// be traced through the logs. The request ID is taken from the X-Request-Id
+// header, if present, or generated otherwise, and is echoed in the response.
+func withRequestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-Id")
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+		w.Header().Set("X-Request-Id", requestID)
+
+		logger := slog.Default().With("request_id", requestID, "method", r.Method, "path", r.URL.Path)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), loggerKey{}, logger)))
+	})
+}
+
+// requestLogger returns the logger attached to r by withRequestLogger, or the
+// default logger if there isn't one
+func requestLogger(r *http.Request) *slog.Logger {
+	return contextLogger(r.Context())
+}
+
+// contextLogger returns the logger attached to ctx by withRequestLogger, or
+// the default logger if there isn't one
+func contextLogger(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// unmatchedResponse captures the status and headers of the response which
+// http.ServeMux writes for a request which doesn't match any route, discarding
+// its plain text body
+type unmatchedResponse struct {
+	header http.Header
+	status int
+}
+
+func (u *unmatchedResponse) Header() http.Header         { return u.header }
+func (u *unmatchedResponse) Write(b []byte) (int, error) { return len(b), nil }
+func (u *unmatchedResponse) WriteHeader(status int)      { u.status = status }
+
+// withUnmatchedRouteLogging is middleware which logs requests that don't match
+// any of mux's routes, and explains why in a small JSON response. Methods are
+// still matched strictly, but a webhook set to HTTP GET in the Twilio Console,
+// rather than POST, is easy to spot.
+func withUnmatchedRouteLogging(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		resp := &unmatchedResponse{header: http.Header{}, status: http.StatusNotFound}
+		mux.ServeHTTP(resp, r)
+		allow := resp.header.Get("Allow")
+
+		message := fmt.Sprintf("There is no route for %s.", r.URL.Path)
+		if resp.status == http.StatusMethodNotAllowed {
+			message = fmt.Sprintf("%s %s is not supported; use %s. If this is a Twilio webhook, check that it is set to HTTP POST in the Twilio Console.", r.Method, r.URL.Path, allow)
+			w.Header().Set("Allow", allow)
+		}
+		requestLogger(r).Warn("Request did not match any route", "status", resp.status, "allow", allow)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.status)
+		json.NewEncoder(w).Encode(map[string]string{"error": message})
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/twilio/twilio-go/twiml"
+)
+
+// machineDetectionEnabled reports whether answering machine detection is
+// enabled for forwarded calls, by setting MACHINE_DETECTION
+func machineDetectionEnabled() bool {
+	return os.Getenv("MACHINE_DETECTION") != ""
+}
+
+// machineDetectionAttributes returns the attributes which have Twilio detect
+// whether a person or a machine answered a <Number> or <Sip>, from
+// MACHINE_DETECTION and its settings, or nil if it isn't enabled. Unset
+// settings are left out, so that Twilio's defaults apply.
+func machineDetectionAttributes() map[string]string {
+	if !machineDetectionEnabled() {
+		return nil
+	}
+	return map[string]string{
+		"machineDetection":                   os.Getenv("MACHINE_DETECTION"),
+		"machineDetectionTimeout":            os.Getenv("MACHINE_DETECTION_TIMEOUT"),
+		"machineDetectionSpeechThreshold":    os.Getenv("MACHINE_DETECTION_SPEECH_THRESHOLD"),
+		"machineDetectionSpeechEndThreshold": os.Getenv("MACHINE_DETECTION_SPEECH_END_THRESHOLD"),
+		"machineDetectionSilenceTimeout":     os.Getenv("MACHINE_DETECTION_SILENCE_TIMEOUT"),
+	}
+}
+
+// forwardNumberElement returns the noun used to forward a call from caller to
+// target: <Client> if it is a Twilio Client identity, <Sip> if it is a SIP URI,
+// or <Number> otherwise. If answering machine detection is enabled, Twilio
+// checks whether a person or a machine answered a number or SIP URI, then
+// requests /machine-detection, on the forwarded leg of the call, before
+// connecting the caller.
+func forwardNumberElement(target, caller string) twiml.Element {
+	if isClientIdentity(target) {
+		return &twiml.VoiceClient{Identity: strings.TrimPrefix(target, clientPrefix), Url: forwardedLegURL(caller)}
+	}
+	if isSIPURI(target) {
+		return &twiml.VoiceSip{SipUrl: target, Url: forwardedLegURL(caller), OptionalAttributes: machineDetectionAttributes()}
+	}
+	return &twiml.VoiceNumber{PhoneNumber: target, Url: forwardedLegURL(caller), OptionalAttributes: machineDetectionAttributes()}
+}
+
+// handleMachineDetection is requested by Twilio, on the forwarded leg of the
+// call, once it has detected who answered. If it was a machine, e.g., a staff
+// member's personal voicemail, that leg is hung up so that the caller falls
+// through to leaving a voicemail with us instead. Otherwise, the whisper, if
+// any, is played and the caller is connected.
+func handleMachineDetection(w http.ResponseWriter, r *http.Request) {
+	answeredBy := r.FormValue("AnsweredBy")
+	requestLogger(r).Info("Forwarded call answered", "answered_by", answeredBy)
+
+	var elements []twiml.Element
+	if strings.HasPrefix(answeredBy, "machine") || answeredBy == "fax" {
+		elements = append(elements, &twiml.VoiceHangup{})
+	} else {
+		elements = whisperElements(r.URL.Query().Get("caller"))
+	}
+
+	twimlResult, err := twiml.Voice(elements)
+	if err != nil {
+		appError(w, fmt.Errorf("could not handle machine detection. reason: %s", err))
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/xml")
+	w.Write([]byte(twimlResult))
+}
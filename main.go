@@ -1,151 +1,1035 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io/fs"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
 	"slices"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/ddymko/go-jsonerror"
 	"github.com/joho/godotenv"
-	naturaldate "github.com/tj/go-naturaldate"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/twilio/twilio-go"
+	"github.com/twilio/twilio-go/client"
 	twilioAPI "github.com/twilio/twilio-go/rest/api/v2010"
 	"github.com/twilio/twilio-go/twiml"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// isDuringBusinessHours checks if the current time is within business hours
-func isDuringBusinessHours(weekStart string, weekEnd string, dayStart int, dayEnd int) (bool, error) {
-	now := time.Now()
-	workWeekStart, err := naturaldate.Parse("last "+weekStart, now)
-	if err != nil {
-		return false, err
+// splitList splits a comma-separated list, trimming whitespace from each item
+// and dropping any which are empty
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
-	workWeekStart = workWeekStart.Add(time.Hour * time.Duration(dayStart))
+	return items
+}
 
-	workWeekEnd, err := naturaldate.Parse("next "+weekEnd, now)
-	if err != nil {
-		return false, err
+// getEnv get key environment variable if exist, otherwise return defaultValue
+// copied from https://stackoverflow.com/a/40326580/222011
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
 	}
-	workWeekEnd = workWeekEnd.Add(time.Hour * time.Duration(dayEnd))
+	return fallback
+}
 
-	workDayStart, err := naturaldate.Parse(strconv.Itoa(dayStart), now)
+// getEnvBool returns the key environment variable as a boolean, or fallback if
+// it isn't set
+func getEnvBool(key string, fallback bool) (bool, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback, nil
+	}
+	parsed, err := strconv.ParseBool(value)
 	if err != nil {
-		return false, err
+		return fallback, fmt.Errorf("%s must be true or false, not %q", key, value)
 	}
+	return parsed, nil
+}
 
-	workDayEnd, err := naturaldate.Parse(strconv.Itoa(dayEnd), now)
-	if err != nil {
-		return false, err
+// getEnvInt returns the key environment variable as a whole number of at
+// least min, or fallback if it isn't set
+func getEnvInt(key string, fallback, min int) (int, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < min {
+		if min == 0 {
+			return fallback, fmt.Errorf("%s must be a whole number, not %q", key, value)
+		}
+		return fallback, fmt.Errorf("%s must be a whole number of at least %d, not %q", key, min, value)
 	}
+	return parsed, nil
+}
 
-	return now.Before(workWeekStart) || now.After(workWeekEnd) || now.Before(workDayStart) || now.After(workDayEnd), nil
+// getEnvDuration returns the key environment variable as a duration, e.g.,
+// 90s, of at least min, or fallback if it isn't set
+func getEnvDuration(key string, fallback, min time.Duration) (time.Duration, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback, nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed < min {
+		if min == 0 {
+			return fallback, fmt.Errorf("%s must be a duration, e.g., 90s, not %q", key, value)
+		}
+		return fallback, fmt.Errorf("%s must be a duration of at least %s, e.g., 90s, not %q", key, min, value)
+	}
+	return parsed, nil
 }
 
-// getEnv get key environment variable if exist, otherwise return defaultValue
-// copied from https://stackoverflow.com/a/40326580/222011
-func getEnv(key, fallback string) string {
-	if value, ok := os.LookupEnv(key); ok {
-		return value
+// badRequestError is an error caused by the request, rather than by the
+// application or a service it depends on
+type badRequestError struct {
+	err error
+}
+
+func (e badRequestError) Error() string { return e.err.Error() }
+func (e badRequestError) Unwrap() error { return e.err }
+
+// badRequest marks err as caused by the request, so that appError responds to
+// it with a 400, rather than a 500
+func badRequest(err error) error {
+	return badRequestError{err: err}
+}
+
+// errorStatus returns the HTTP status for err: 400 if it was caused by the
+// request, as marked by badRequest, or 500 otherwise
+func errorStatus(err error) int {
+	if errors.As(err, &badRequestError{}) {
+		return http.StatusBadRequest
 	}
-	return fallback
+	return http.StatusInternalServerError
 }
 
+// appError responds with err as a JSON error, with the status from
+// errorStatus. Its Content-Type replaces any which the handler had already
+// set, e.g., application/xml for TwiML.
 func appError(w http.ResponseWriter, err error) {
+	status := errorStatus(err)
+
 	var error jsonerror.ErrorJSON
 	error.AddError(jsonerror.ErrorComp{
 		Detail: err.Error(),
-		Code:   strconv.Itoa(http.StatusBadRequest),
+		Code:   strconv.Itoa(status),
 		Title:  "Something went wrong",
-		Status: http.StatusBadRequest,
+		Status: status,
 	})
-	http.Error(w, error.Error(), http.StatusBadRequest)
+
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	fmt.Fprintln(w, error.Error())
+}
+
+// fallbackTwiML is the TwiML used when even the fallback voicemail TwiML can't
+// be generated, so that the caller hears something before being hung up on
+const fallbackTwiML = `<?xml version="1.0" encoding="UTF-8"?><Response><Say>Sorry, we can't take your call right now. Please try again later.</Say><Hangup/></Response>`
+
+// callError logs err, which stopped a call from being routed, and responds
+// with TwiML which sends the call to voicemail, rather than with appError,
+// which Twilio can't follow, and so would drop the call. As a last resort, it
+// doesn't check VOICEMAIL_RATE_LIMIT, which could itself be what failed.
+func callError(w http.ResponseWriter, r *http.Request, cfg config, err error) {
+	callsTotal.WithLabelValues("fallback").Inc()
+	requestLogger(r).Error("Could not route call, sending it to voicemail instead", "error", err)
+
+	twimlResult, voiceErr := twiml.Voice(voicemailElements(cfg, "", r.FormValue("From"), r.FormValue("To")))
+	if voiceErr != nil {
+		requestLogger(r).Error("Could not send call to voicemail", "error", voiceErr)
+		twimlResult = fallbackTwiML
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(twimlResult))
+}
+
+// e164Pattern matches phone numbers in E.164 format, e.g., +14155552671
+var e164Pattern = regexp.MustCompile(`^\+[1-9]\d{1,14}$`)
+
+// validateE164 checks that number is in E.164 format, which Twilio requires
+func validateE164(number string) error {
+	if !e164Pattern.MatchString(number) {
+		return fmt.Errorf("%q is not in E.164 format; it must start with a + and the country code, followed by up to 14 digits, with no spaces or punctuation, e.g., +14155552671", number)
+	}
+	return nil
+}
+
+// publicBaseURL returns PUBLIC_BASE_URL, the URL at which Twilio reaches the
+// application, e.g., https://example.com/voicemail, without a trailing slash.
+// It is empty if not set.
+func publicBaseURL() string {
+	return strings.TrimSuffix(os.Getenv("PUBLIC_BASE_URL"), "/")
+}
+
+// validatePublicBaseURL checks that PUBLIC_BASE_URL, if set, is an absolute
+// http or https URL, without a query or fragment
+func validatePublicBaseURL() error {
+	value := publicBaseURL()
+	if value == "" {
+		return nil
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("PUBLIC_BASE_URL must be an absolute http or https URL, e.g., https://example.com, not %q", value)
+	}
+	return nil
+}
+
+// publicURL returns the URL, for Twilio to request, of path on the
+// application. If PUBLIC_BASE_URL is set, this is an absolute URL; otherwise,
+// it is just path, which Twilio resolves relative to the request it made.
+func publicURL(path string) string {
+	return publicBaseURL() + path
+}
+
+// requestOrigin reconstructs the scheme and host that Twilio used to make the
+// request, taking into account any TLS-terminating proxy, such as ngrok, in
+// front of the application. If PUBLIC_BASE_URL is set, it is used instead, so
+// that this includes any path prefix that the application is mounted under.
+func requestOrigin(r *http.Request) string {
+	if base := publicBaseURL(); base != "" {
+		return base
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// requestURL reconstructs the full URL that Twilio used to make the request
+func requestURL(r *http.Request) string {
+	return requestOrigin(r) + r.URL.RequestURI()
+}
+
+// validateTwilioSignature returns middleware which rejects, with a 403, any
+// request without an X-Twilio-Signature header signed with cfg's auth token,
+// so that only Twilio can reach the wrapped handler. Validation can be
+// disabled for local testing by setting DISABLE_SIGNATURE_VALIDATION to true.
+func validateTwilioSignature(cfg config) middleware {
+	validator := client.NewRequestValidator(cfg.twilioAuthToken)
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if cfg.disableSignatureValidation {
+				next(w, r)
+				return
+			}
+
+			if err := r.ParseForm(); err != nil {
+				appError(w, badRequest(fmt.Errorf("could not parse request. reason: %s", err)))
+				return
+			}
+			params := make(map[string]string, len(r.PostForm))
+			for key := range r.PostForm {
+				params[key] = r.PostForm.Get(key)
+			}
+
+			if !validator.Validate(requestURL(r), params, r.Header.Get("X-Twilio-Signature")) {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+
+			next(w, r)
+		}
+	}
+}
+
+// voicemailGreetingKeys are the environment variables holding the voicemail
+// greeting for each reason that a call can go to voicemail
+var voicemailGreetingKeys = map[routingReason]string{
+	reasonWeekend:    "VOICEMAIL_GREETING_WEEKEND",
+	reasonHoliday:    "VOICEMAIL_GREETING_HOLIDAY",
+	reasonLunch:      "VOICEMAIL_GREETING_LUNCH",
+	reasonAfterHours: "VOICEMAIL_GREETING_AFTER_HOURS",
+	reasonVacation:   "VOICEMAIL_GREETING_VACATION",
+}
+
+// voicemailGreeting returns the message spoken to callers before they record
+// a voicemail, for reason, e.g., VOICEMAIL_GREETING_HOLIDAY on a holiday. If
+// there is no greeting for reason, VOICEMAIL_GREETING is used.
+func voicemailGreeting(reason routingReason) string {
+	greeting := getEnv("VOICEMAIL_GREETING", "Sorry, nobody is available to take your call. Please leave a message after the beep, and press the pound key when you are finished.")
+	if key, ok := voicemailGreetingKeys[reason]; ok {
+		greeting = getEnv(key, greeting)
+	}
+	return greeting
+}
+
+// voicemailElements returns the TwiML which greets the caller, tells them when
+// to start speaking with RECORDING_PROMPT, if it is set, and then records their
+// voicemail, for their call to called, with recordElement
+func voicemailElements(cfg config, reason routingReason, caller, called string) []twiml.Element {
+	elements := []twiml.Element{greetingElement(voicemailGreeting(reason))}
+	if cfg.recordingPrompt != "" {
+		elements = append(elements, greetingElement(cfg.recordingPrompt))
+	}
+	return append(elements, recordElement(cfg, reason, 1, caller, called))
+}
+
+// recordElement returns the TwiML which records caller's attempt'th try at
+// their voicemail, for their call to called, which is sent to
+// transcribeCallbackPath, along with the reason the call went to voicemail, if
+// known, its language, and the caller and called numbers, signed with
+// callToken, and transcribed as cfg's transcriber configures it. Once the
+// caller has recorded their message, Twilio requests /voicemail-complete,
+// which either lets them record it again, or thanks them and hangs up.
+func recordElement(cfg config, reason routingReason, attempt int, caller, called string) *twiml.VoiceRecord {
+	query := url.Values{}
+	if reason != "" {
+		query.Set("reason", string(reason))
+	}
+	if language := transcribeLanguage(); language != "" {
+		query.Set("language", language)
+	}
+	if caller != "" || called != "" {
+		query.Set("caller", caller)
+		query.Set("called", called)
+		query.Set("call_token", callToken(cfg.twilioAuthToken, caller, called))
+	}
+	callback := publicURL(cfg.transcribeCallbackPath)
+	if len(query) > 0 {
+		callback += "?" + query.Encode()
+	}
+
+	complete := url.Values{}
+	complete.Set("attempt", strconv.Itoa(attempt))
+	if reason != "" {
+		complete.Set("reason", string(reason))
+	}
+
+	// Trimming silence before and after the message means it isn't recorded,
+	// or transcribed, unless RECORDING_TRIM_SILENCE is false
+	trim := "do-not-trim"
+	if cfg.recordingTrimSilence {
+		trim = "trim-silence"
+	}
+
+	record := &twiml.VoiceRecord{
+		Action:      publicURL("/voicemail-complete") + "?" + complete.Encode(),
+		FinishOnKey: cfg.recordingFinishKey,
+		MaxLength:   strconv.Itoa(cfg.recordingMaxLength),
+		Timeout:     strconv.Itoa(cfg.recordingTimeout),
+		PlayBeep:    strconv.FormatBool(cfg.recordingPlayBeep),
+		Trim:        trim,
+	}
+	cfg.transcriber.configure(record, callback)
+	return record
+}
+
+// callToken returns the token which shows that the caller and called numbers
+// in a voicemail callback's query were put there by recordElement. It is
+// derived from the auth token, as recordingToken is, so they can't be forged.
+func callToken(authToken, caller, called string) string {
+	return recordingToken(authToken, url.Values{"caller": {caller}, "called": {called}}.Encode())
+}
+
+// voicemailCall returns the caller and called numbers of the voicemail which
+// Twilio's callback r is for. Recording status callbacks have no From or To,
+// so these are the numbers in r's query, if callToken signed them, or r's
+// From and To otherwise.
+func voicemailCall(r *http.Request, authToken string) (caller, called string) {
+	query := r.URL.Query()
+	caller, called = query.Get("caller"), query.Get("called")
+	if token := query.Get("call_token"); token != "" && hmac.Equal([]byte(token), []byte(callToken(authToken, caller, called))) {
+		return caller, called
+	}
+	return r.FormValue("From"), r.FormValue("To")
+}
+
+// closingElements returns the TwiML played once the caller has recorded their
+// voicemail, which is CLOSING_MESSAGE, if it is set, in the same voice as the
+// greeting, and then hangs up
+func closingElements(cfg config) []twiml.Element {
+	var elements []twiml.Element
+	if cfg.closingMessage != "" {
+		elements = append(elements, greetingElement(cfg.closingMessage))
+	}
+	return append(elements, &twiml.VoiceHangup{})
+}
+
+// voicemailRedirect returns the TwiML which sends the call to /voicemail, for
+// reason, e.g., once a <Gather> ends without the caller pressing a key, so
+// that they only count towards VOICEMAIL_RATE_LIMIT if they do go to voicemail
+func voicemailRedirect(reason routingReason) *twiml.VoiceRedirect {
+	return &twiml.VoiceRedirect{Url: publicURL("/voicemail?" + url.Values{"reason": {string(reason)}}.Encode())}
+}
+
+// handleVoicemail returns a handler which sends the call, redirected by
+// voicemailRedirect, to voicemail, unless limiter says the caller has left too
+// many recently
+func handleVoicemail(cfg config, limiter *rateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := cfg.forCalled(r.FormValue("To"))
+		reason := routingReason(r.URL.Query().Get("reason"))
+		twimlResult, err := twiml.Voice(limiter.voicemail(r.Context(), cfg, reason, r.FormValue("From"), r.FormValue("To")))
+		if err != nil {
+			appError(w, fmt.Errorf("could not record voice call. reason: %s", err))
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/xml")
+		w.Write([]byte(twimlResult))
+	}
+}
+
+// handleVoicemailComplete is requested by Twilio once the caller has finished
+// recording their voicemail. If RECORDING_MAX_ATTEMPTS allows it, the caller
+// is asked whether to keep it, with reviewElements; otherwise, the call ends
+// with closingElements. Without it, Twilio would request the call's webhook
+// again, and play the greeting a second time.
+func handleVoicemailComplete(cfg config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		elements := closingElements(cfg)
+		if attempt, sid := requestAttempt(r), r.FormValue("RecordingSid"); sid != "" && attempt < cfg.recordingMaxAttempts {
+			elements = reviewElements(cfg, routingReason(r.URL.Query().Get("reason")), attempt, sid)
+		}
+
+		twimlResult, err := twiml.Voice(elements)
+		if err != nil {
+			appError(w, fmt.Errorf("could not end the call. reason: %s", err))
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/xml")
+		w.Write([]byte(twimlResult))
+	}
+}
+
+// requireAdminToken is middleware which only lets requests through to the
+// wrapped handler if they carry ADMIN_TOKEN as a bearer token. If ADMIN_TOKEN
+// isn't set, all requests are rejected.
+func requireAdminToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := os.Getenv("ADMIN_TOKEN")
+		provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
 }
 
 // handleCallRequest forwards incoming calls to a specified number during
 // business hours; by default, business hours are Monday to Friday 8:00-18:00
-// UTC.  Otherwise, it directs the call to voicemail. If the call is directed to
+// UTC, though the timezone can be changed with WORK_TIMEZONE.  Otherwise, or on
+// a holiday, it directs the call to voicemail. If the call is directed to
 // voicemail, a message can be recorded and a link of the recording sent via SMS
-// to the configured phone number.
-func handleCallRequest(w http.ResponseWriter, r *http.Request) {
-	workWeekStart := getEnv("WORK_WEEK_START", "Monday")
-	workWeekEnd := getEnv("WORK_WEEK_END", "Friday")
-	workDayStart, _ := strconv.Atoi(getEnv("WORK_DAY_START", "8"))
-	workDayEnd, _ := strconv.Atoi(getEnv("WORK_DAY_END", "18"))
-
-	duringBusinessHours, err := isDuringBusinessHours(workWeekStart, workWeekEnd, workDayStart, workDayEnd)
-	if err != nil {
-		appError(w, fmt.Errorf("could not determine if current time is within business hours. reason: %s", err))
-		return
-	}
+// to the configured phone number. If there is an on-call number, after-hours
+// calls are forwarded to it first, and only go to voicemail if it doesn't
+// answer, except during the vacation, when every call goes to voicemail.
+// Calls from BLOCKED_NUMBERS are rejected and, if ALLOWED_NUMBERS is set,
+// calls from anyone else go to voicemail, as do calls from outside
+// FORWARD_COUNTRY_CODES, if it is set. With USE_QUEUE, calls during business
+// hours are queued instead of being forwarded, and, with USE_CONFERENCE,
+// joined to a conference of their own. Callers who have left more voicemails
+// than limiter allows are told to try again later. Calls to the Twilio number
+// of an office in OFFICES_JSON use that office's timezone, hours, and forward
+// numbers, and override, if set, replaces the business hours. With
+// SCREEN_CALLERS, callers must press a key, with screeningElements, before
+// their call is forwarded by handleScreen. If tmpl is set, its TwiML is returned instead of
+// the built-in TwiML. If the call can't be routed, it is sent to voicemail
+// with callError.
+func handleCallRequest(cfg config, limiter *rateLimiter, override *hoursOverride, tmpl *twimlTemplate) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracer.Start(r.Context(), "handleCallRequest")
+		defer span.End()
+		r = r.WithContext(ctx)
 
-	w.Header().Add("Content-Type", "application/xml")
+		cfg := cfg.forCalled(r.FormValue("To"))
+		caller := r.FormValue("From")
+		if normalized, err := normalizeNumber(caller); err == nil {
+			caller = normalized
+		}
+		logger := requestLogger(r).With("caller", caller)
+		callData := func(decision string, reason routingReason, numbers []string) twimlTemplateData {
+			return twimlTemplateData{Decision: decision, Reason: string(reason), Caller: caller, Called: r.FormValue("To"), Numbers: numbers, Timezone: cfg.location.String(), BaseURL: publicBaseURL()}
+		}
 
-	if !duringBusinessHours {
-		record := &twiml.VoiceRecord{
-			FinishOnKey:        "#",
-			MaxLength:          "300",
-			Timeout:            "10",
-			Transcribe:         "true",
-			TranscribeCallback: "/sms",
+		if isBlockedCaller(cfg, caller) {
+			twimlResult, err := tmpl.voice(blockedCallerElements(cfg), callData("blocked", "", nil))
+			if err != nil {
+				callError(w, r, cfg, fmt.Errorf("could not reject call. reason: %s", err))
+				return
+			}
+			callsTotal.WithLabelValues("blocked").Inc()
+			logger.Info("Routing call", "decision", "blocked")
+			logger.Debug("Generated TwiML", "decision", "blocked", "twiml", twimlResult)
+			w.Header().Add("Content-Type", "application/xml")
+			w.Write([]byte(twimlResult))
+			return
 		}
-		twimlResult, err := twiml.Voice([]twiml.Element{record})
-		if err == nil {
-			appError(w, fmt.Errorf("could not record voice call. reason: %s", err))
+
+		now := clock().In(cfg.location)
+		_, hoursSpan := tracer.Start(ctx, "businessHours")
+		duringBusinessHours, reason := override.current(ctx).apply(cfg.businessHours(now))
+		hoursSpan.SetAttributes(attribute.Bool("open", duringBusinessHours), attribute.String("reason", string(reason)))
+		hoursSpan.End()
+		canForward := isAllowedCaller(cfg, caller) && isForwardedRegion(cfg, caller)
+		if duringBusinessHours && !canForward {
+			duringBusinessHours, reason = false, reasonNotAllowed
+			if !isForwardedRegion(cfg, caller) {
+				reason = reasonOutsideRegion
+			}
+		}
+		logger = logger.With("reason", reason)
+
+		w.Header().Add("Content-Type", "application/xml")
+
+		if !duringBusinessHours {
+			if onCall := onCallNumber(cfg, now); onCall != "" && canForward && reason != reasonVacation && reason != reasonForcedVoicemail {
+				twimlResult, err := tmpl.voice(onCallElements(cfg, onCall, caller, reason), callData("on_call", reason, []string{onCall}))
+				if err != nil {
+					callError(w, r, cfg, fmt.Errorf("could not redirect call. reason: %s", err))
+					return
+				}
+				callsTotal.WithLabelValues("on_call").Inc()
+				logger.Info("Routing call", "decision", "on_call", "numbers", []string{onCall})
+				logger.Debug("Generated TwiML", "decision", "on_call", "twiml", twimlResult)
+				w.Write([]byte(twimlResult))
+				return
+			}
+
+			if !limiter.allow(r.Context(), caller) {
+				twimlResult, err := tmpl.voice(rateLimitedElements(), callData("rate_limited", reason, nil))
+				if err != nil {
+					callError(w, r, cfg, fmt.Errorf("could not reject call. reason: %s", err))
+					return
+				}
+				callsTotal.WithLabelValues("rate_limited").Inc()
+				logger.Warn("Routing call", "decision", "rate_limited")
+				logger.Debug("Generated TwiML", "decision", "rate_limited", "twiml", twimlResult)
+				w.Write([]byte(twimlResult))
+				return
+			}
+
+			twimlResult, err := tmpl.voice(voicemailElements(cfg, reason, caller, r.FormValue("To")), callData("voicemail", reason, nil))
+			if err != nil {
+				callError(w, r, cfg, fmt.Errorf("could not record voice call. reason: %s", err))
+				return
+			}
+			callsTotal.WithLabelValues("voicemail").Inc()
+			logger.Info("Routing call", "decision", "voicemail")
+			logger.Debug("Generated TwiML", "decision", "voicemail", "twiml", twimlResult)
+			w.Write([]byte(twimlResult))
+			return
+		}
+
+		if cfg.useQueue {
+			twimlResult, err := tmpl.voice(queueElements(cfg, reasonNoAnswer), callData("queue", reason, nil))
+			if err != nil {
+				callError(w, r, cfg, fmt.Errorf("could not queue call. reason: %s", err))
+				return
+			}
+			callsTotal.WithLabelValues("queue").Inc()
+			logger.Info("Routing call", "decision", "queue", "queue", cfg.queueName)
+			logger.Debug("Generated TwiML", "decision", "queue", "twiml", twimlResult)
+			w.Write([]byte(twimlResult))
+			return
 		}
+
+		if cfg.useConference {
+			conference := callerConference(cfg, r.FormValue("CallSid"))
+			twimlResult, err := tmpl.voice(conferenceElements(cfg, r.FormValue("CallSid"), reasonNoAnswer), callData("conference", reason, nil))
+			if err != nil {
+				callError(w, r, cfg, fmt.Errorf("could not join call to the conference. reason: %s", err))
+				return
+			}
+			callsTotal.WithLabelValues("conference").Inc()
+			logger.Info("Routing call", "decision", "conference", "conference", conference)
+			logger.Debug("Generated TwiML", "decision", "conference", "twiml", twimlResult)
+			w.Write([]byte(twimlResult))
+			return
+		}
+
+		numbers := forwardNumbersAt(now, cfg.forwardWindows, cfg.forwardNumbers)
+		if cfg.screenCallers {
+			twimlResult, err := tmpl.voice(screeningElements(cfg), callData("screen", reason, numbers))
+			if err != nil {
+				callError(w, r, cfg, fmt.Errorf("could not screen call. reason: %s", err))
+				return
+			}
+			callsTotal.WithLabelValues("screen").Inc()
+			logger.Info("Routing call", "decision", "screen", "numbers", numbers)
+			logger.Debug("Generated TwiML", "decision", "screen", "twiml", twimlResult)
+			w.Write([]byte(twimlResult))
+			return
+		}
+
+		twimlResult, err := tmpl.voice(forwardElements(cfg, numbers, caller, cfg.ringStrategy), callData("forward", reason, numbers))
+		if err != nil {
+			callError(w, r, cfg, fmt.Errorf("could not redirect call. reason: %s", err))
+			return
+		}
+		callsTotal.WithLabelValues("forward").Inc()
+		logger.Info("Routing call", "decision", "forward", "numbers", numbers)
+		logger.Debug("Generated TwiML", "decision", "forward", "twiml", twimlResult)
 		w.Write([]byte(twimlResult))
-		return
 	}
+}
+
+// messageSender sends SMS messages. It is satisfied by the Twilio REST client's
+// Api service, and can be replaced with a fake in tests.
+type messageSender interface {
+	CreateMessage(params *twilioAPI.CreateMessageParams) (*twilioAPI.ApiV2010Message, error)
+}
+
+// voicemailMessage composes the body of a voicemail notification from the
+// transcription and a link to the recording. If there is no transcription,
+// e.g., because it failed, it just says that a voicemail was left.
+func voicemailMessage(transcription, recordingLink string) string {
+	if transcription == "" {
+		if recordingLink == "" {
+			return "Voicemail received — transcription unavailable."
+		}
+		return fmt.Sprintf("Voicemail received — transcription unavailable, listen: %s", recordingLink)
+	}
+	if recordingLink == "" {
+		return transcription
+	}
+	return fmt.Sprintf("%s\n\nListen: %s", transcription, recordingLink)
+}
 
-	dial := &twiml.VoiceDial{Number: os.Getenv("MY_PHONE_NUMBER")}
-	say := &twiml.VoiceSay{Message: "Sorry, I was unable to redirect you. Goodbye."}
-	twimlResult, err := twiml.Voice([]twiml.Element{dial, say})
-	if err == nil {
-		appError(w, fmt.Errorf("could not redirect call. reason: %s", err))
+// createMessageWithContext sends an SMS message using sender, giving up if ctx
+// is done before Twilio responds. The Twilio client doesn't accept a context,
+// so the request itself is not cancelled; its result is discarded.
+func createMessageWithContext(ctx context.Context, sender messageSender, params *twilioAPI.CreateMessageParams) (*twilioAPI.ApiV2010Message, error) {
+	type result struct {
+		resp *twilioAPI.ApiV2010Message
+		err  error
 	}
+
+	_, span := tracer.Start(ctx, "twilio.create_message")
+	done := make(chan result, 1)
+	go func() {
+		timer := prometheus.NewTimer(twilioAPIDuration.WithLabelValues("create_message"))
+		resp, err := sender.CreateMessage(params)
+		timer.ObserveDuration()
+		done <- result{resp, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		endSpan(span, ctx.Err())
+		return nil, ctx.Err()
+	case res := <-done:
+		endSpan(span, res.err)
+		return res.resp, res.err
+	}
+}
+
+// sendVoiceRecording returns a handler which receives a POST request (from
+// Twilio) for a voice recording, and, once it has acknowledged it, with tasks,
+// has transcriber transcribe it, if it wasn't already, saves it to store, and
+// then sends it to each of notifiers, so that Twilio isn't kept waiting, and
+// doesn't retry the callback. A failure on one channel doesn't stop the
+// others, and Twilio is always sent a 200, even if the callback is missing the
+// CallSid or RecordingUrl, in which case it is logged and ignored. SMS
+// notifications are sent from TWILIO_PHONE_NUMBER, and include the caller's
+// number, from voicemailCall, as callbacks which only carry the recording
+// don't have it, and use the configuration of the office that they called.
+// If names is not nil, the caller's name is looked up and included in
+// the notifications. If archive is not nil, the recording is copied to S3 and
+// the notifications link to the copy, or to the recording on Twilio if it
+// couldn't be copied. Recordings in discarded, which the caller chose to
+// record again, are ignored. With NOTIFY_ON_RECORDING, staff have already been
+// sent the recording, so the notifications are labelled as its transcription,
+// and aren't sent at all if there isn't one.
+func sendVoiceRecording(notifiers []notifier, transcriber transcriber, archive *recordingArchive, store *voicemailStore, names *callerNames, discarded *discardedRecordings, tasks *backgroundTasks, cfg config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracer.Start(r.Context(), "sendVoiceRecording", trace.WithAttributes(attribute.String("call_sid", r.FormValue("CallSid"))))
+		defer span.End()
+		r = r.WithContext(ctx)
+
+		if discarded.discarded(r.Context(), r.FormValue("RecordingSid")) {
+			requestLogger(r).Info("Ignoring voicemail which the caller recorded again", "recording_sid", r.FormValue("RecordingSid"))
+			acknowledgeCallback(w)
+			return
+		}
+
+		if missing := missingFormValues(r, "CallSid", "RecordingUrl"); len(missing) > 0 {
+			requestLogger(r).Error("Voicemail callback is missing required fields, so no notification was sent", "missing", missing)
+			acknowledgeCallback(w)
+			return
+		}
+
+		caller, called := voicemailCall(r, cfg.twilioAuthToken)
+		cfg := cfg.forCalled(called)
+		acknowledgeCallback(w)
+		tasks.run(ctx, func(ctx context.Context) {
+			ctx, span := tracer.Start(ctx, "handleVoicemail")
+			defer span.End()
+			r := r.WithContext(ctx)
+
+			transcribeCtx, transcribeSpan := tracer.Start(ctx, "transcribe")
+			transcription, err := transcriber.transcribe(transcribeCtx, cfg.twilioAccountSID, cfg.twilioAuthToken, r)
+			endSpan(transcribeSpan, err)
+			if err != nil {
+				requestLogger(r).Warn("Voicemail could not be transcribed", "error", err)
+			}
+
+			receivedAt := requestTime(r).In(cfg.notifyLocation)
+			duration, _ := strconv.Atoi(r.FormValue("RecordingDuration"))
+			saveCtx, saveSpan := tracer.Start(ctx, "store.save")
+			err = store.save(saveCtx, voicemail{
+				Caller:        caller,
+				ReceivedAt:    receivedAt,
+				RecordingURL:  r.FormValue("RecordingUrl"),
+				Transcription: transcription,
+				CallSID:       r.FormValue("CallSid"),
+				Called:        called,
+				Direction:     r.FormValue("Direction"),
+				Duration:      duration,
+			})
+			endSpan(saveSpan, err)
+			if err != nil {
+				requestLogger(r).Error("Could not save voicemail", "error", err)
+			}
+
+			link := recordingLink(requestOrigin(r), cfg.twilioAuthToken, r.FormValue("RecordingSid"), r.FormValue("RecordingUrl"))
+			if archive != nil && recordingSIDPattern.MatchString(r.FormValue("RecordingSid")) {
+				archiveCtx, archiveSpan := tracer.Start(ctx, "archiveRecording")
+				archiveCtx, cancel := context.WithTimeout(archiveCtx, cfg.apiTimeout)
+				archived, err := archive.archive(archiveCtx, cfg.twilioAccountSID, cfg.twilioAuthToken, r.FormValue("RecordingSid"))
+				cancel()
+				endSpan(archiveSpan, err)
+				if err != nil {
+					recordingArchiveFailuresTotal.Inc()
+					requestLogger(r).Error("Could not archive recording, linking to it on Twilio instead", "recording_sid", r.FormValue("RecordingSid"), "error", err)
+				} else {
+					link = archived
+				}
+			}
+
+			event := voicemailEvent{
+				Caller:        caller,
+				Transcription: transcription,
+				RecordingURL:  link,
+				ReceivedAt:    receivedAt,
+				Reason:        routingReason(r.URL.Query().Get("reason")),
+				Language:      r.URL.Query().Get("language"),
+				CallSID:       r.FormValue("CallSid"),
+				timeLayout:    cfg.notifyTimeLayout,
+				followUp:      cfg.notifyOnRecording,
+			}
+			if event.followUp && transcription == "" {
+				requestLogger(r).Info("Voicemail has no transcription to follow up its recording notification with, so no notification was sent")
+				return
+			}
+			event.CallerName = names.lookup(r.Context(), event.Caller, requestLogger(r).With("caller", event.Caller))
+
+			notifyCtx, notifySpan := tracer.Start(ctx, "notifyAll")
+			notifyAll(notifyCtx, notifiers, event)
+			notifySpan.End()
+		})
+	}
+}
+
+// requestTime returns when Twilio sent r, from its Timestamp parameter, if it
+// has one, or the current time otherwise
+func requestTime(r *http.Request) time.Time {
+	if sent, err := time.Parse(time.RFC1123Z, r.FormValue("Timestamp")); err == nil {
+		return sent
+	}
+	return clock()
+}
+
+// missingFormValues returns those of keys which r has no value for
+func missingFormValues(r *http.Request, keys ...string) []string {
+	var missing []string
+	for _, key := range keys {
+		if r.FormValue(key) == "" {
+			missing = append(missing, key)
+		}
+	}
+	return missing
+}
+
+// acknowledgeCallback responds to a Twilio callback with empty TwiML, and a
+// 200, so that Twilio doesn't retry it. Failures to notify anyone of a
+// voicemail are logged and counted, rather than reported to Twilio, as
+// retrying the callback would also repeat the notifications which succeeded.
+func acknowledgeCallback(w http.ResponseWriter) {
+	twimlResult, err := twiml.Voice(nil)
+	if err != nil {
+		appError(w, fmt.Errorf("could not acknowledge callback. reason: %s", err))
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/xml")
 	w.Write([]byte(twimlResult))
 }
 
-// sendVoiceRecording receives a POST request (from Twilio) with a text
-// transcription of a voice recording which it then sends to the specified phone
-// number via SMS.
-func sendVoiceRecording(w http.ResponseWriter, r *http.Request) {
-	client := twilio.NewRestClientWithParams(twilio.ClientParams{
-		Username: os.Getenv("TWILIO_ACCOUNT_SID"),
-		Password: os.Getenv("TWILIO_AUTH_TOKEN"),
-	})
+// smsSuccessStatuses are the message statuses which show that Twilio accepted
+// an SMS for sending, or has already sent it. Any other status, including
+// failed, undelivered, canceled, or none at all, means it won't be delivered.
+var smsSuccessStatuses = []string{"accepted", "scheduled", "queued", "sending", "sent", "delivered"}
+
+// sendVoicemailSMS sends body, via SMS, to recipient, retrying transient
+// failures according to retry within timeout. It returns Twilio's response, if
+// there was one, and an error if the message couldn't be sent, or if Twilio
+// reports that it failed.
+func sendVoicemailSMS(ctx context.Context, sender messageSender, recipient, from, body string, timeout time.Duration, retry retryPolicy, logger *slog.Logger) (*twilioAPI.ApiV2010Message, error) {
 	params := &twilioAPI.CreateMessageParams{}
-	params.SetTo(os.Getenv("MY_PHONE_NUMBER"))
-	params.SetFrom(r.FormValue("from"))
-	params.SetBody(r.FormValue("transcription_text"))
+	params.SetTo(recipient)
+	params.SetFrom(from)
+	params.SetBody(body)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-	resp, err := client.Api.CreateMessage(params)
+	resp, err := createMessageWithRetry(ctx, sender, params, retry, logger)
+	if errors.Is(err, context.DeadlineExceeded) {
+		smsSentTotal.WithLabelValues("timeout").Inc()
+		logger.Error("Timed out sending voicemail SMS", "timeout", timeout.String())
+		return nil, fmt.Errorf("timed out after %s sending SMS message", timeout)
+	}
 	if err != nil {
-		fmt.Println("Error sending SMS message: " + err.Error())
+		smsSentTotal.WithLabelValues("error").Inc()
+		logger.Error("Could not send voicemail SMS", "error", err)
+		return nil, err
 	}
 
-	message := "The SMS with the voice recording transcript was sent successfully."
-	if slices.Contains([]string{"cancelled", "failed", "undelivered"}, *resp.Status) {
-		message = "Something went wrong sending the SMS with the voice recording transcript."
+	status := "unknown"
+	if resp != nil && resp.Status != nil && *resp.Status != "" {
+		status = strings.ToLower(*resp.Status)
 	}
+	smsSentTotal.WithLabelValues(status).Inc()
+	logger = logger.With("sms_status", status)
 
-	w.Write([]byte(message))
+	if !slices.Contains(smsSuccessStatuses, status) {
+		logger.Warn("Voicemail SMS was not sent")
+		return resp, fmt.Errorf("SMS message status is %s", status)
+	}
+	logger.Info("Voicemail SMS sent")
+	return resp, nil
+}
+
+// requiredEnvVars returns the environment variables which must be set for the
+// application to work, including TWILIO_PHONE_NUMBER if loadConfig requires
+// it, as reported by twilioPhoneNumberRequired
+func requiredEnvVars() []string {
+	required := []string{"TWILIO_ACCOUNT_SID", "TWILIO_AUTH_TOKEN", "MY_PHONE_NUMBER"}
+	// An invalid NOTIFY_SMS is reported by loadConfig, so is taken as the
+	// default here
+	notifySMS, _ := getEnvBool("NOTIFY_SMS", true)
+	if twilioPhoneNumberRequired(notifySMS) != "" {
+		required = append(required, "TWILIO_PHONE_NUMBER")
+	}
+	return required
+}
+
+// missingEnvVars returns the required environment variables which are not set
+func missingEnvVars() []string {
+	var missing []string
+	for _, key := range requiredEnvVars() {
+		if os.Getenv(key) == "" {
+			missing = append(missing, key)
+		}
+	}
+	return missing
+}
+
+// handleHealthCheck reports whether the application is ready to handle calls,
+// for load balancers and readiness probes. It returns a 503 if any of the
+// required environment variables are not set.
+func handleHealthCheck(w http.ResponseWriter, r *http.Request) {
+	missing := missingEnvVars()
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(missing) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]any{"status": "unavailable", "missing": missing})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
 func main() {
 	err := godotenv.Load()
+	// The logger is only set up once .env is loaded, as it may set LOG_LEVEL
+	slog.SetDefault(newLogger())
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.Info("No .env file found, using environment variables only")
+	} else if err != nil {
+		fatal("Error loading .env file", "error", err)
+	}
+
+	if err := applyFlags(os.Args[1:]); errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	} else if err != nil {
+		fatal("Invalid command-line flags", "error", err)
+	}
+
+	if missing := missingEnvVars(); len(missing) > 0 {
+		fatal("Required environment variables are not set", "missing", missing)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+
+	store, err := openVoicemailStore(cfg.databasePath)
+	if err != nil {
+		fatal("Could not open voicemail database", "error", err)
+	}
+	defer store.close()
+
+	twilioClient := twilio.NewRestClientWithParams(twilio.ClientParams{
+		Username: cfg.twilioAccountSID,
+		Password: cfg.twilioAuthToken,
+	})
+	twilioClient.SetTimeout(cfg.apiTimeout)
+
+	if cfg.validateCredentialsOnStart {
+		if err := checkCredentials(twilioClient.Api, cfg.twilioAccountSID); err != nil {
+			fatal("Twilio credentials are not valid", "error", err)
+		}
+		slog.Info("Twilio credentials are valid")
+	}
+
+	var sender messageSender = twilioClient.Api
+	if cfg.dryRun {
+		slog.Warn("DRY_RUN is enabled, so SMS messages will be logged instead of sent")
+		sender = dryRunSender{}
+	}
+
+	tmpl, err := loadTwiMLTemplate(cfg)
+	if err != nil {
+		fatal("Invalid TwiML template", "error", err)
+	}
+
+	archive, err := newRecordingArchive()
+	if err != nil {
+		fatal("Invalid recording storage configuration", "error", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := setupTracing(ctx)
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		fatal("Invalid tracing configuration", "error", err)
 	}
 
+	redisState, err := newRedisStore(ctx)
+	if err != nil {
+		fatal("Invalid Redis configuration", "error", err)
+	}
+	var state stateStore
+	if redisState != nil {
+		defer redisState.close()
+		slog.Info("Sharing state between replicas in Redis")
+		state = redisState
+	} else {
+		memoryState := newMemoryStore()
+		go memoryState.cleanupEvery(ctx, time.Minute)
+		state = memoryState
+	}
+
+	limiter := newRateLimiter(cfg.voicemailRateLimit, cfg.voicemailRateWindow, state)
+	calls := newCallLimiter(cfg.maxConcurrentCalls)
+	replays := newReplayGuard(cfg.replayWindow, state)
+	override := newHoursOverride(state)
+	discarded := newDiscardedRecordings(state)
+	callbacks := newCallbackDeduper(cfg.callbackDedupWindow, state)
+	tasks := newBackgroundTasks()
+
+	// Every Twilio webhook is validated, and checked for replays, and incoming
+	// calls are also limited to MAX_CONCURRENT_CALLS. Repeats of the callbacks
+	// which notify staff of voicemails are acknowledged before they can be
+	// rejected as replays.
+	twilioWebhook := chain(validateTwilioSignature(cfg), replays.check)
+	incomingCall := chain(twilioWebhook, calls.limit)
+	voicemailCallback := chain(validateTwilioSignature(cfg), callbacks.check, replays.check)
+
+	notifiers := newNotifiers(cfg, sender)
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("POST /", handleCallRequest)
-	mux.HandleFunc("POST /sms", sendVoiceRecording)
+	mux.HandleFunc("POST /", incomingCall(handleCallRequest(cfg, limiter, override, tmpl)))
+	mux.HandleFunc("POST "+cfg.transcribeCallbackPath, voicemailCallback(sendVoiceRecording(notifiers, cfg.transcriber, archive, store, newCallerNames(twilioClient.LookupsV2, cfg), discarded, tasks, cfg)))
+	mux.HandleFunc("POST /menu", incomingCall(handleMenu(cfg)))
+	mux.HandleFunc("POST /screen", twilioWebhook(handleScreen(cfg, limiter)))
+	mux.HandleFunc("POST /handle-key", twilioWebhook(handleMenuKey(cfg, limiter)))
+	mux.HandleFunc("POST /callback-number", twilioWebhook(handleCallbackNumber(sender, tasks, cfg)))
+	mux.HandleFunc("POST /machine-detection", twilioWebhook(handleMachineDetection))
+	mux.HandleFunc("POST /whisper", twilioWebhook(handleWhisper))
+	mux.HandleFunc("POST /dial-status", twilioWebhook(handleDialStatus(cfg, limiter)))
+	mux.HandleFunc("POST /recording-status", voicemailCallback(handleRecordingStatus(notifiers, tasks, cfg)))
+	mux.HandleFunc("POST /voicemail", twilioWebhook(handleVoicemail(cfg, limiter)))
+	mux.HandleFunc("POST /voicemail-complete", twilioWebhook(handleVoicemailComplete(cfg)))
+	mux.HandleFunc("POST /voicemail-review", twilioWebhook(handleVoicemailReview(discarded, cfg)))
+	mux.HandleFunc("POST /queue-status", twilioWebhook(handleQueueStatus(cfg, limiter)))
+	mux.HandleFunc("POST /dequeue", twilioWebhook(handleDequeue(cfg)))
+	mux.HandleFunc("POST /conference", twilioWebhook(handleJoinConference(twilioClient.Api, cfg)))
+	mux.HandleFunc("POST /conference-wait", twilioWebhook(handleConferenceWait(twilioClient.Api)))
+	mux.HandleFunc("POST /conference-status", twilioWebhook(handleConferenceStatus(cfg, limiter)))
+	mux.HandleFunc("GET /recordings/{sid}", proxyRecording(cfg.twilioAccountSID, cfg.twilioAuthToken))
+	mux.HandleFunc("GET /config", requireAdminToken(handleConfig(cfg)))
+	mux.HandleFunc("POST /test-notification", requireAdminToken(handleTestNotification(notifiers, cfg)))
+	mux.HandleFunc("GET /voicemails", requireAdminToken(listVoicemails(store, cfg.location)))
+	mux.HandleFunc("GET /health", handleHealthCheck)
+	mux.HandleFunc("GET /status", handleStatus(cfg, override))
+	mux.HandleFunc("POST /admin/force-voicemail", requireAdminToken(handleSetOverride(override, overrideVoicemail)))
+	mux.HandleFunc("POST /admin/force-open", requireAdminToken(handleSetOverride(override, overrideOpen)))
+	mux.HandleFunc("POST /admin/clear-override", requireAdminToken(handleSetOverride(override, overrideNone)))
+	mux.Handle("GET /metrics", promhttp.Handler())
 
-	log.Print("Starting server on :8080")
-	err = http.ListenAndServe(":8080", mux)
-	log.Fatal(err)
+	server := &http.Server{Addr: cfg.addr, Handler: withRequestLogger(withUnmatchedRouteLogging(mux))}
+
+	go func() {
+		slog.Info("Starting server", "addr", cfg.addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("Server failed", "error", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+
+	slog.Info("Shutting down server, waiting for in-flight requests", "timeout", cfg.shutdownTimeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		fatal("Could not shut down server cleanly", "error", err)
+	}
+	if err := tasks.wait(shutdownCtx); err != nil {
+		slog.Error("Could not finish the remaining background tasks", "error", err)
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Could not export the remaining spans", "error", err)
+	}
+	slog.Info("Server shut down")
 }
@@ -0,0 +1,1000 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	twilioAPI "github.com/twilio/twilio-go/rest/api/v2010"
+	"github.com/twilio/twilio-go/twiml"
+)
+
+// fakeSender is a messageSender which records the messages it is asked to
+// send, rather than sending them, and responds with err, if set, or a message
+// with status otherwise. If block is set, it waits for block to be closed
+// before responding.
+type fakeSender struct {
+	status string
+	err    error
+	block  chan struct{}
+
+	mu   sync.Mutex
+	sent []*twilioAPI.CreateMessageParams
+}
+
+func (s *fakeSender) CreateMessage(params *twilioAPI.CreateMessageParams) (*twilioAPI.ApiV2010Message, error) {
+	if s.block != nil {
+		<-s.block
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, params)
+	if s.err != nil {
+		return nil, s.err
+	}
+	status := s.status
+	return &twilioAPI.ApiV2010Message{Status: &status}, nil
+}
+
+// messages returns the messages which s was asked to send
+func (s *fakeSender) messages() []*twilioAPI.CreateMessageParams {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*twilioAPI.CreateMessageParams(nil), s.sent...)
+}
+
+// discardLogger returns a logger which logs nothing, for tests
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// unsetenv unsets key until the test ends, so that its default is used
+func unsetenv(t *testing.T, key string) {
+	t.Helper()
+	t.Setenv(key, "")
+	os.Unsetenv(key)
+}
+
+// noRetry tries each request once, so that failures are reported straight away
+var noRetry = retryPolicy{maxAttempts: 1}
+
+func TestSendVoicemailSMSSuccess(t *testing.T) {
+	sender := &fakeSender{status: "queued"}
+
+	resp, err := sendVoicemailSMS(context.Background(), sender, "+14155550100", "+14155550199", "Hello", time.Second, noRetry, discardLogger())
+	if err != nil {
+		t.Fatalf("sendVoicemailSMS returned %v, want no error", err)
+	}
+	if resp == nil || *resp.Status != "queued" {
+		t.Errorf("sendVoicemailSMS returned %+v, want the queued message", resp)
+	}
+
+	sent := sender.messages()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(sent))
+	}
+	if *sent[0].To != "+14155550100" || *sent[0].From != "+14155550199" || *sent[0].Body != "Hello" {
+		t.Errorf("sent To %q, From %q, Body %q, want +14155550100, +14155550199, Hello", *sent[0].To, *sent[0].From, *sent[0].Body)
+	}
+}
+
+func TestSendVoicemailSMSFailure(t *testing.T) {
+	sender := &fakeSender{err: errors.New("invalid To number")}
+
+	resp, err := sendVoicemailSMS(context.Background(), sender, "+14155550100", "+14155550199", "Hello", time.Second, noRetry, discardLogger())
+	if err == nil {
+		t.Fatal("sendVoicemailSMS returned no error, want the sender's error")
+	}
+	if resp != nil {
+		t.Errorf("sendVoicemailSMS returned %+v, want no message", resp)
+	}
+}
+
+func TestSendVoicemailSMSUndelivered(t *testing.T) {
+	sender := &fakeSender{status: "undelivered"}
+
+	resp, err := sendVoicemailSMS(context.Background(), sender, "+14155550100", "+14155550199", "Hello", time.Second, noRetry, discardLogger())
+	if err == nil || err.Error() != "SMS message status is undelivered" {
+		t.Errorf("sendVoicemailSMS returned %v, want an undelivered error", err)
+	}
+	if resp == nil {
+		t.Error("sendVoicemailSMS returned no message, want the undelivered one")
+	}
+}
+
+func TestSendVoicemailSMSTimeout(t *testing.T) {
+	sender := &fakeSender{status: "queued", block: make(chan struct{})}
+	defer close(sender.block)
+
+	_, err := sendVoicemailSMS(context.Background(), sender, "+14155550100", "+14155550199", "Hello", 10*time.Millisecond, noRetry, discardLogger())
+	if err == nil || !strings.HasPrefix(err.Error(), "timed out after 10ms") {
+		t.Errorf("sendVoicemailSMS returned %v, want a timeout", err)
+	}
+}
+
+func TestSendVoicemailSMSStatuses(t *testing.T) {
+	tests := []struct {
+		status  string
+		wantErr string
+	}{
+		{"accepted", ""},
+		{"scheduled", ""},
+		{"queued", ""},
+		{"sending", ""},
+		{"sent", ""},
+		{"delivered", ""},
+		{"QUEUED", ""},
+		{"Delivered", ""},
+		{"failed", "SMS message status is failed"},
+		{"undelivered", "SMS message status is undelivered"},
+		{"canceled", "SMS message status is canceled"},
+		{"receiving", "SMS message status is receiving"},
+		{"", "SMS message status is unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			sender := &fakeSender{status: tt.status}
+
+			_, err := sendVoicemailSMS(context.Background(), sender, "+14155550100", "+14155550199", "Hello", time.Second, noRetry, discardLogger())
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("sendVoicemailSMS returned %v, want no error", err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("sendVoicemailSMS returned %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// setenvOrUnset sets key to *value, or unsets it if value is nil
+func setenvOrUnset(t *testing.T, key string, value *string) {
+	t.Helper()
+	unsetenv(t, key)
+	if value != nil {
+		t.Setenv(key, *value)
+	}
+}
+
+func TestValidateE164(t *testing.T) {
+	tests := []struct {
+		name    string
+		number  string
+		wantErr bool
+	}{
+		{name: "valid", number: "+14155552671"},
+		{name: "shortest", number: "+12"},
+		{name: "longest", number: "+123456789012345"},
+		{name: "missing +", number: "14155552671", wantErr: true},
+		{name: "too long", number: "+1234567890123456", wantErr: true},
+		{name: "too short", number: "+1", wantErr: true},
+		{name: "letters", number: "+1415555CALL", wantErr: true},
+		{name: "spaces", number: "+1 415 555 2671", wantErr: true},
+		{name: "leading zero", number: "+04155552671", wantErr: true},
+		{name: "empty", number: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateE164(tt.number); (err != nil) != tt.wantErr {
+				t.Errorf("validateE164(%q) returned %v, want error: %t", tt.number, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetEnvInt(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   *string
+		min     int
+		want    int
+		wantErr string
+	}{
+		{name: "unset", want: 3},
+		{name: "set", value: ptr("5"), want: 5},
+		{name: "zero", value: ptr("0"), want: 0},
+		{name: "below the minimum", value: ptr("0"), min: 1, want: 3, wantErr: `TEST_SETTING must be a whole number of at least 1, not "0"`},
+		{name: "negative", value: ptr("-1"), want: 3, wantErr: `TEST_SETTING must be a whole number, not "-1"`},
+		{name: "empty", value: ptr(""), want: 3, wantErr: `TEST_SETTING must be a whole number, not ""`},
+		{name: "not a number", value: ptr("five"), want: 3, wantErr: `TEST_SETTING must be a whole number, not "five"`},
+		{name: "not whole", value: ptr("2.5"), want: 3, wantErr: `TEST_SETTING must be a whole number, not "2.5"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenvOrUnset(t, "TEST_SETTING", tt.value)
+			got, err := getEnvInt("TEST_SETTING", 3, tt.min)
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+			if gotErr := errorString(err); gotErr != tt.wantErr {
+				t.Errorf("got error %q, want %q", gotErr, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetEnvBool(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   *string
+		want    bool
+		wantErr string
+	}{
+		{name: "unset", want: true},
+		{name: "false", value: ptr("false"), want: false},
+		{name: "0", value: ptr("0"), want: false},
+		{name: "TRUE", value: ptr("TRUE"), want: true},
+		{name: "empty", value: ptr(""), want: true, wantErr: `TEST_SETTING must be true or false, not ""`},
+		{name: "not a boolean", value: ptr("no"), want: true, wantErr: `TEST_SETTING must be true or false, not "no"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenvOrUnset(t, "TEST_SETTING", tt.value)
+			got, err := getEnvBool("TEST_SETTING", true)
+			if got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+			if gotErr := errorString(err); gotErr != tt.wantErr {
+				t.Errorf("got error %q, want %q", gotErr, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetEnvDuration(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   *string
+		min     time.Duration
+		want    time.Duration
+		wantErr string
+	}{
+		{name: "unset", want: time.Minute},
+		{name: "seconds", value: ptr("90s"), want: 90 * time.Second},
+		{name: "hours and minutes", value: ptr("1h30m"), want: 90 * time.Minute},
+		{name: "zero", value: ptr("0s"), want: 0},
+		{name: "below the minimum", value: ptr("0s"), min: time.Second, want: time.Minute, wantErr: `TEST_SETTING must be a duration of at least 1s, e.g., 90s, not "0s"`},
+		{name: "negative", value: ptr("-1s"), want: time.Minute, wantErr: `TEST_SETTING must be a duration, e.g., 90s, not "-1s"`},
+		{name: "empty", value: ptr(""), want: time.Minute, wantErr: `TEST_SETTING must be a duration, e.g., 90s, not ""`},
+		{name: "no unit", value: ptr("90"), want: time.Minute, wantErr: `TEST_SETTING must be a duration, e.g., 90s, not "90"`},
+		{name: "not a duration", value: ptr("soon"), want: time.Minute, wantErr: `TEST_SETTING must be a duration, e.g., 90s, not "soon"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenvOrUnset(t, "TEST_SETTING", tt.value)
+			got, err := getEnvDuration("TEST_SETTING", time.Minute, tt.min)
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			if gotErr := errorString(err); gotErr != tt.wantErr {
+				t.Errorf("got error %q, want %q", gotErr, tt.wantErr)
+			}
+		})
+	}
+}
+
+// errorString returns err's message, or an empty string if it is nil
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// signedForm is a Twilio request, whose X-Twilio-Signature, from the auth
+// token 12345, signs http://example.com/sms with these parameters
+var signedForm = url.Values{
+	"CallSid":      {"CA1234567890ABCDE"},
+	"From":         {"+14155552671"},
+	"RecordingUrl": {"https://api.twilio.com/recording"},
+}
+
+const knownGoodSignature = "QhCiAGGvNCM2gMuXl+tValSXzGY="
+
+// postForm returns a POST request to target with form as its body
+func postForm(target string, form url.Values) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func TestValidateTwilioSignature(t *testing.T) {
+	t.Setenv("TWILIO_AUTH_TOKEN", "12345")
+	t.Setenv("PUBLIC_BASE_URL", "")
+	t.Setenv("DISABLE_SIGNATURE_VALIDATION", "false")
+	cfg := testConfig(t)
+
+	tests := []struct {
+		name      string
+		signature string
+		want      int
+	}{
+		{"known-good signature", knownGoodSignature, http.StatusOK},
+		{"wrong signature", "bm90IHRoZSByaWdodCBzaWduYXR1cmU=", http.StatusForbidden},
+		{"no signature", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reached := false
+			handler := validateTwilioSignature(cfg)(func(w http.ResponseWriter, r *http.Request) {
+				reached = true
+			})
+
+			r := postForm("/sms", signedForm)
+			if tt.signature != "" {
+				r.Header.Set("X-Twilio-Signature", tt.signature)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d", w.Code, tt.want)
+			}
+			if reached != (tt.want == http.StatusOK) {
+				t.Errorf("handler reached: %t, want %t", reached, tt.want == http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestValidateTwilioSignatureDisabled(t *testing.T) {
+	t.Setenv("TWILIO_AUTH_TOKEN", "12345")
+	t.Setenv("DISABLE_SIGNATURE_VALIDATION", "true")
+	cfg := testConfig(t)
+
+	reached := false
+	handler := validateTwilioSignature(cfg)(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	})
+	handler(httptest.NewRecorder(), postForm("/sms", signedForm))
+
+	if !reached {
+		t.Error("handler wasn't reached with DISABLE_SIGNATURE_VALIDATION set")
+	}
+}
+
+// testConfig returns the configuration loaded from an environment with only
+// the required settings, which forwards calls to, and notifies,
+// +14155550100, from the Twilio number +14155550199. Failed SMS aren't
+// retried, so that tests don't wait for them.
+func testConfig(t *testing.T) config {
+	t.Helper()
+	t.Setenv("MY_PHONE_NUMBER", "+14155550100")
+	t.Setenv("TWILIO_PHONE_NUMBER", "+14155550199")
+	t.Setenv("HOLIDAYS_FILE", filepath.Join(t.TempDir(), "holidays.json"))
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig returned %v", err)
+	}
+	cfg.retry = noRetry
+	return cfg
+}
+
+// testStore returns a voicemail store in a temporary directory
+func testStore(t *testing.T) *voicemailStore {
+	t.Helper()
+	store, err := openVoicemailStore(filepath.Join(t.TempDir(), "voicemails.db"))
+	if err != nil {
+		t.Fatalf("openVoicemailStore returned %v", err)
+	}
+	t.Cleanup(func() { store.close() })
+	return store
+}
+
+// voicemailForm is the transcription callback of a voicemail
+var voicemailForm = url.Values{
+	"CallSid":           {"CA1234567890ABCDE"},
+	"From":              {"+14155552671"},
+	"RecordingSid":      {"RE1234567890ABCDE1234567890ABCDE"},
+	"RecordingUrl":      {"https://api.twilio.com/2010-04-01/Accounts/AC123/Recordings/RE1234567890ABCDE1234567890ABCDE"},
+	"TranscriptionText": {"Hi, it's Sam, please call me back."},
+}
+
+func TestSendVoiceRecordingSMSError(t *testing.T) {
+	cfg := testConfig(t)
+	sender := &fakeSender{err: errors.New("Twilio is unavailable")}
+	handler := sendVoiceRecording(newNotifiers(cfg, sender), twilioTranscriber{}, nil, testStore(t), nil, nil, nil, cfg)
+
+	w := httptest.NewRecorder()
+	handler(w, postForm("/sms", voicemailForm))
+
+	// Twilio is still sent a 200, so that it doesn't retry the callback
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if sent := sender.messages(); len(sent) != 1 {
+		t.Errorf("tried to send %d messages, want 1", len(sent))
+	}
+}
+
+func TestSendVoiceRecordingMissingFields(t *testing.T) {
+	cfg := testConfig(t)
+
+	tests := []struct {
+		name    string
+		missing []string
+	}{
+		{"empty", []string{"CallSid", "From", "RecordingSid", "RecordingUrl", "TranscriptionText"}},
+		{"no CallSid", []string{"CallSid"}},
+		{"no RecordingUrl", []string{"RecordingUrl"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := maps.Clone(voicemailForm)
+			for _, key := range tt.missing {
+				form.Del(key)
+			}
+			sender := &fakeSender{status: "queued"}
+			handler := sendVoiceRecording(newNotifiers(cfg, sender), twilioTranscriber{}, nil, testStore(t), nil, nil, nil, cfg)
+
+			w := httptest.NewRecorder()
+			handler(w, postForm("/sms", form))
+
+			if w.Code != http.StatusOK {
+				t.Errorf("got status %d, want %d", w.Code, http.StatusOK)
+			}
+			if sent := sender.messages(); len(sent) != 0 {
+				t.Errorf("sent %d messages, want none", len(sent))
+			}
+		})
+	}
+}
+
+func TestSendVoiceRecordingStatusCallback(t *testing.T) {
+	t.Setenv("TRANSCRIBE_PROVIDER", "webhook")
+	t.Setenv("TRANSCRIBE_WEBHOOK_URL", "https://example.com/transcribe")
+	cfg := testConfig(t)
+
+	record := recordElement(cfg, reasonAfterHours, 1, "+14155552671", "+14155550199")
+	callback, err := url.Parse(record.RecordingStatusCallback)
+	if err != nil {
+		t.Fatalf("could not parse the RecordingStatusCallback %q: %v", record.RecordingStatusCallback, err)
+	}
+	forged := callback.Query()
+	forged.Set("caller", "+12125550100")
+
+	// A recording status callback has no From, To, or Direction
+	form := url.Values{
+		"AccountSid":        {"AC123"},
+		"CallSid":           {"CA1234567890ABCDE"},
+		"RecordingSid":      {"RE1234567890ABCDE1234567890ABCDE"},
+		"RecordingUrl":      {"https://api.twilio.com/2010-04-01/Accounts/AC123/Recordings/RE1234567890ABCDE1234567890ABCDE"},
+		"RecordingStatus":   {"completed"},
+		"RecordingDuration": {"12"},
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		wantCaller bool
+	}{
+		{"signed", callback.RawQuery, true},
+		{"forged", forged.Encode(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &fakeSender{status: "queued"}
+			handler := sendVoiceRecording(newNotifiers(cfg, sender), twilioTranscriber{}, nil, testStore(t), nil, nil, nil, cfg)
+
+			handler(httptest.NewRecorder(), postForm(callback.Path+"?"+tt.query, form))
+
+			sent := sender.messages()
+			if len(sent) != 1 {
+				t.Fatalf("sent %d messages, want 1", len(sent))
+			}
+			body := *sent[0].Body
+			if strings.Contains(body, "+14155552671") != tt.wantCaller {
+				t.Errorf("message includes the caller: %t, want %t: %s", !tt.wantCaller, tt.wantCaller, body)
+			}
+			if strings.Contains(body, "+12125550100") {
+				t.Errorf("message includes the forged caller: %s", body)
+			}
+		})
+	}
+}
+
+func TestSendVoiceRecordingUntranscribedLanguage(t *testing.T) {
+	// Twilio can't transcribe Polish, so only sends the recording
+	t.Setenv("TRANSCRIBE_LANGUAGE", "pl-PL")
+	cfg := testConfig(t)
+
+	record := recordElement(cfg, reasonAfterHours, 1, "+14155552671", "+14155550199")
+	if record.Transcribe != "" || record.RecordingStatusCallback == "" {
+		t.Fatalf("<Record> has Transcribe %q and RecordingStatusCallback %q, want only a RecordingStatusCallback", record.Transcribe, record.RecordingStatusCallback)
+	}
+
+	sender := &fakeSender{status: "queued"}
+	handler := sendVoiceRecording(newNotifiers(cfg, sender), twilioTranscriber{}, nil, testStore(t), nil, nil, nil, cfg)
+	handler(httptest.NewRecorder(), postForm(record.RecordingStatusCallback, url.Values{
+		"CallSid":         {"CA1234567890ABCDE"},
+		"RecordingSid":    {"RE1234567890ABCDE1234567890ABCDE"},
+		"RecordingUrl":    {"https://api.twilio.com/2010-04-01/Accounts/AC123/Recordings/RE1234567890ABCDE1234567890ABCDE"},
+		"RecordingStatus": {"completed"},
+	}))
+
+	sent := sender.messages()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(sent))
+	}
+	if body := *sent[0].Body; !strings.Contains(body, "+14155552671") || !strings.Contains(body, "Language: pl-PL") {
+		t.Errorf("message doesn't include the caller and the language: %s", body)
+	}
+}
+
+func TestHandleRecordingStatus(t *testing.T) {
+	t.Setenv("NOTIFY_ON_RECORDING", "true")
+	cfg := testConfig(t)
+
+	record := recordElement(cfg, reasonAfterHours, 1, "+14155552671", "+14155550199")
+	if !strings.Contains(record.RecordingStatusCallback, "/recording-status?") {
+		t.Fatalf("<Record> has RecordingStatusCallback %q, want it at /recording-status", record.RecordingStatusCallback)
+	}
+
+	sender := &fakeSender{status: "queued", block: make(chan struct{})}
+	tasks := newBackgroundTasks()
+	handler := handleRecordingStatus(newNotifiers(cfg, sender), tasks, cfg)
+
+	// Twilio is answered while the SMS is still being sent
+	w := httptest.NewRecorder()
+	handler(w, postForm(record.RecordingStatusCallback, url.Values{
+		"CallSid":         {"CA1234567890ABCDE"},
+		"RecordingSid":    {"RE1234567890ABCDE1234567890ABCDE"},
+		"RecordingUrl":    {"https://api.twilio.com/2010-04-01/Accounts/AC123/Recordings/RE1234567890ABCDE1234567890ABCDE"},
+		"RecordingStatus": {"completed"},
+	}))
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	close(sender.block)
+	if err := tasks.wait(context.Background()); err != nil {
+		t.Fatalf("tasks.wait returned %v", err)
+	}
+	sent := sender.messages()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(sent))
+	}
+	if body := *sent[0].Body; !strings.Contains(body, "+14155552671") || !strings.Contains(body, "the transcription will follow") {
+		t.Errorf("message doesn't include the caller, and say that the transcription will follow: %s", body)
+	}
+}
+
+// twilioSignature returns the X-Twilio-Signature which Twilio, with authToken,
+// signs a POST of form to target with
+func twilioSignature(authToken, target string, form url.Values) string {
+	keys := make([]string, 0, len(form))
+	for key := range form {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	payload := target
+	for _, key := range keys {
+		payload += key + form.Get(key)
+	}
+	mac := hmac.New(sha1.New, []byte(authToken))
+	mac.Write([]byte(payload))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestHandleCallbackNumberRetry(t *testing.T) {
+	t.Setenv("TWILIO_AUTH_TOKEN", "12345")
+	t.Setenv("PUBLIC_BASE_URL", "")
+	t.Setenv("REPLAY_WINDOW", "1h")
+	cfg := testConfig(t)
+	replays := newReplayGuard(cfg.replayWindow, newMemoryStore())
+	handler := chain(validateTwilioSignature(cfg), replays.check)(handleCallbackNumber(&fakeSender{status: "queued"}, nil, cfg))
+
+	// The caller enters the same invalid number twice
+	form := url.Values{"CallSid": {"CA1234567890ABCDE"}, "From": {"+14155552671"}, "To": {"+14155550199"}, "Digits": {"123"}}
+	post := func(target string) *httptest.ResponseRecorder {
+		r := postForm(target, form)
+		r.Header.Set("X-Twilio-Signature", twilioSignature("12345", "http://example.com"+target, form))
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	first := post("/callback-number?attempt=1")
+	if first.Code != http.StatusOK || !strings.Contains(first.Body.String(), "/callback-number?attempt=2") {
+		t.Fatalf("got status %d, want %d, asking for the number again at attempt 2: %s", first.Code, http.StatusOK, first.Body.String())
+	}
+	if again := post("/callback-number?attempt=2"); again.Code != http.StatusOK {
+		t.Errorf("entering the same number again got status %d, want %d", again.Code, http.StatusOK)
+	}
+	if replayed := post("/callback-number?attempt=1"); replayed.Code != http.StatusForbidden {
+		t.Errorf("replaying the first attempt got status %d, want %d", replayed.Code, http.StatusForbidden)
+	}
+}
+
+// pinClock makes clock return now until the test ends
+func pinClock(t *testing.T, now time.Time) {
+	t.Helper()
+	clock = func() time.Time { return now }
+	t.Cleanup(func() { clock = time.Now })
+}
+
+// callForm is an incoming call from +14155552671 to the Twilio number
+var callForm = url.Values{
+	"CallSid": {"CA1234567890ABCDE"},
+	"From":    {"+14155552671"},
+	"To":      {"+14155550199"},
+}
+
+func TestHandleCallRequestTwiMLError(t *testing.T) {
+	cfg := testConfig(t)
+	// Wednesday, during business hours
+	pinClock(t, time.Date(2024, time.June, 12, 10, 0, 0, 0, time.UTC))
+	// .Missing isn't a field of the template's data, so rendering fails
+	// partway through
+	tmpl := &twimlTemplate{tmpl: template.Must(template.New("twiml").Parse(`<Response><Say>Partial</Say>{{.Missing}}</Response>`))}
+
+	w := httptest.NewRecorder()
+	handleCallRequest(cfg, nil, nil, tmpl)(w, postForm("/", callForm))
+
+	body := w.Body.String()
+	if strings.Contains(body, "Partial") {
+		t.Errorf("response contains the partly rendered template: %s", body)
+	}
+	if strings.Count(body, "<Response>") != 1 || !strings.Contains(body, "<Record") {
+		t.Errorf("response doesn't send the call to voicemail: %s", body)
+	}
+}
+
+func TestHandleCallRequest(t *testing.T) {
+	cfg := testConfig(t)
+
+	tests := []struct {
+		name        string
+		now         time.Time
+		want        string
+		wantMissing string
+	}{
+		{"in hours", time.Date(2024, time.June, 12, 10, 0, 0, 0, time.UTC), "<Dial", "<Record"},
+		{"out of hours", time.Date(2024, time.June, 12, 20, 0, 0, 0, time.UTC), "<Record", "<Dial"},
+		{"weekend", time.Date(2024, time.June, 15, 10, 0, 0, 0, time.UTC), "<Record", "<Dial"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pinClock(t, tt.now)
+
+			w := httptest.NewRecorder()
+			handleCallRequest(cfg, nil, nil, nil)(w, postForm("/", callForm))
+
+			if w.Code != http.StatusOK {
+				t.Errorf("got status %d, want %d", w.Code, http.StatusOK)
+			}
+			if contentType := w.Header().Get("Content-Type"); contentType != "application/xml" {
+				t.Errorf("got Content-Type %q, want application/xml", contentType)
+			}
+			body := w.Body.String()
+			if !strings.Contains(body, tt.want) || strings.Contains(body, tt.wantMissing) {
+				t.Errorf("TwiML has no %s, or has a %s: %s", tt.want, tt.wantMissing, body)
+			}
+		})
+	}
+}
+
+func TestHandleCallRequestScreening(t *testing.T) {
+	t.Setenv("SCREEN_CALLERS", "true")
+	t.Setenv("FORWARD_NUMBERS", "+14155550101,+14155550102")
+	cfg := testConfig(t)
+	// Wednesday, during business hours
+	pinClock(t, time.Date(2024, time.June, 12, 10, 0, 0, 0, time.UTC))
+	tmpl := &twimlTemplate{tmpl: template.Must(template.New("twiml").Parse(`<Response><Say>{{.Decision}} {{range .Numbers}}{{.}} {{end}}</Say></Response>`))}
+
+	w := httptest.NewRecorder()
+	handleCallRequest(cfg, nil, nil, tmpl)(w, postForm("/", callForm))
+	if body := w.Body.String(); !strings.Contains(body, "screen +14155550101 +14155550102") {
+		t.Errorf("template wasn't rendered for a screened call to the forward numbers: %s", body)
+	}
+
+	w = httptest.NewRecorder()
+	handleScreen(cfg, nil)(w, postForm("/screen", url.Values{"From": {"+14155552671"}, "To": {"+14155550199"}, "Digits": {"1"}}))
+	body := w.Body.String()
+	for _, want := range []string{"+14155550101", "+14155550102", `sequential="true"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("screened call isn't forwarded with %s: %s", want, body)
+		}
+	}
+}
+
+func TestVoicemailRateLimit(t *testing.T) {
+	t.Setenv("RATE_LIMIT_MESSAGE", "Too many messages.")
+	cfg := testConfig(t)
+	limiter := newRateLimiter(1, time.Hour, newMemoryStore())
+	form := url.Values{"From": {"+14155552671"}, "To": {"+14155550199"}, "DialCallStatus": {"no-answer"}}
+
+	w := httptest.NewRecorder()
+	handleDialStatus(cfg, limiter)(w, postForm("/dial-status?reason=no-answer", form))
+	if body := w.Body.String(); !strings.Contains(body, "<Record") {
+		t.Errorf("first unanswered call isn't sent to voicemail: %s", body)
+	}
+
+	w = httptest.NewRecorder()
+	handleDialStatus(cfg, limiter)(w, postForm("/dial-status?reason=no-answer", form))
+	if body := w.Body.String(); strings.Contains(body, "<Record") || !strings.Contains(body, "Too many messages.") {
+		t.Errorf("second unanswered call isn't rate limited: %s", body)
+	}
+
+	w = httptest.NewRecorder()
+	handleVoicemail(cfg, limiter)(w, postForm("/voicemail?reason=unscreened", form))
+	if body := w.Body.String(); strings.Contains(body, "<Record") || !strings.Contains(body, "Too many messages.") {
+		t.Errorf("redirected call isn't rate limited: %s", body)
+	}
+
+	// Gather fallbacks redirect to /voicemail, rather than recording, so
+	// that only callers who don't press a key are counted
+	w = httptest.NewRecorder()
+	handleMenu(cfg)(w, postForm("/menu", form))
+	if body := w.Body.String(); strings.Contains(body, "<Record") || !strings.Contains(body, "/voicemail?reason=</Redirect>") {
+		t.Errorf("menu doesn't fall back to /voicemail: %s", body)
+	}
+}
+
+func TestHandleHealthCheck(t *testing.T) {
+	tests := []struct {
+		name        string
+		notifySMS   *string
+		callbackKey *string
+		wantMissing bool
+	}{
+		{name: "SMS notifications", wantMissing: true},
+		{name: "invalid NOTIFY_SMS", notifySMS: ptr("sometimes"), wantMissing: true},
+		{name: "no SMS notifications", notifySMS: ptr("false")},
+		{name: "callback requests", notifySMS: ptr("false"), callbackKey: ptr("9"), wantMissing: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TWILIO_ACCOUNT_SID", "AC00000000000000000000000000000000")
+			t.Setenv("TWILIO_AUTH_TOKEN", "token")
+			t.Setenv("MY_PHONE_NUMBER", "+14155550100")
+			unsetenv(t, "TWILIO_PHONE_NUMBER")
+			setenvOrUnset(t, "NOTIFY_SMS", tt.notifySMS)
+			setenvOrUnset(t, "MENU_CALLBACK_KEY", tt.callbackKey)
+
+			w := httptest.NewRecorder()
+			handleHealthCheck(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+			body := w.Body.String()
+			if got := strings.Contains(body, "TWILIO_PHONE_NUMBER"); got != tt.wantMissing {
+				t.Errorf("got TWILIO_PHONE_NUMBER missing %t, want %t: %s", got, tt.wantMissing, body)
+			}
+			wantStatus := http.StatusOK
+			if tt.wantMissing {
+				wantStatus = http.StatusServiceUnavailable
+			}
+			if w.Code != wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, wantStatus)
+			}
+		})
+	}
+}
+
+func TestAppErrorJSON(t *testing.T) {
+	w := httptest.NewRecorder()
+	// Handlers set this before writing TwiML, which appError must replace
+	w.Header().Set("Content-Type", "application/xml")
+
+	appError(w, errors.New("could not redirect call"))
+
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("got Content-Type %q, want application/json", contentType)
+	}
+	if !json.Valid(w.Body.Bytes()) {
+		t.Errorf("body isn't valid JSON: %s", w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "could not redirect call") {
+		t.Errorf("body doesn't include the error: %s", w.Body.String())
+	}
+}
+
+func TestVoicemailElementOrder(t *testing.T) {
+	unsetenv(t, "VOICEMAIL_GREETING")
+	unsetenv(t, "RECORDING_PROMPT")
+	unsetenv(t, "RECORDING_MAX_ATTEMPTS")
+	t.Setenv("CLOSING_MESSAGE", "Thank you for your message. Goodbye.")
+	cfg := testConfig(t)
+
+	document := voiceXML(t, voicemailElements(cfg, reasonAfterHours, "+14155552671", "+14155550199"))
+	greeting, record := strings.Index(document, "Sorry, nobody is available"), strings.Index(document, "<Record")
+	if greeting < 0 || record < 0 || greeting > record {
+		t.Errorf("TwiML doesn't greet the caller before the <Record>: %s", document)
+	}
+	if !strings.Contains(document, "/voicemail-complete") {
+		t.Errorf("<Record> doesn't finish at /voicemail-complete: %s", document)
+	}
+
+	w := httptest.NewRecorder()
+	handleVoicemailComplete(cfg)(w, postForm("/voicemail-complete?attempt=1", url.Values{"RecordingSid": {"RE1234567890ABCDE"}}))
+
+	body := w.Body.String()
+	closing, hangup := strings.Index(body, "Thank you for your message. Goodbye."), strings.Index(body, "<Hangup")
+	if closing < 0 || hangup < 0 || closing > hangup {
+		t.Errorf("TwiML doesn't play the closing message before the <Hangup>: %s", body)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"server error", errors.New("could not save voicemail"), http.StatusInternalServerError},
+		{"bad request", badRequest(errors.New("invalid from filter")), http.StatusBadRequest},
+		{"wrapped bad request", fmt.Errorf("could not list voicemails: %w", badRequest(errors.New("invalid from filter"))), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorStatus(tt.err); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+
+			w := httptest.NewRecorder()
+			appError(w, tt.err)
+			if w.Code != tt.want {
+				t.Errorf("appError responded with %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordElementPlayBeep(t *testing.T) {
+	tests := []struct {
+		name  string
+		value *string
+		want  string
+	}{
+		{"default", nil, `playBeep="true"`},
+		{"on", ptr("true"), `playBeep="true"`},
+		{"off", ptr("false"), `playBeep="false"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenvOrUnset(t, "RECORDING_PLAY_BEEP", tt.value)
+			cfg := testConfig(t)
+
+			document := voiceXML(t, []twiml.Element{recordElement(cfg, reasonAfterHours, 1, "+14155552671", "+14155550199")})
+			if !strings.Contains(document, tt.want) {
+				t.Errorf("<Record> doesn't have %s: %s", tt.want, document)
+			}
+		})
+	}
+}
+
+func TestLoadConfigInvalidRecording(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+	}{
+		{"RECORDING_PLAY_BEEP", "quiet"},
+		{"RECORDING_TRIM_SILENCE", "sometimes"},
+		{"RECORDING_MAX_LENGTH", "0"},
+		{"RECORDING_TIMEOUT", "ten"},
+		{"RECORDING_FINISH_KEY", "x"},
+		{"RECORDING_MAX_ATTEMPTS", "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			t.Setenv("MY_PHONE_NUMBER", "+14155550100")
+			t.Setenv("TWILIO_PHONE_NUMBER", "+14155550199")
+			t.Setenv("HOLIDAYS_FILE", filepath.Join(t.TempDir(), "holidays.json"))
+			t.Setenv(tt.key, tt.value)
+
+			_, err := loadConfig()
+			if err == nil || !strings.Contains(err.Error(), tt.key) {
+				t.Errorf("got error %v for %s %q, want one about %s", err, tt.key, tt.value, tt.key)
+			}
+		})
+	}
+}
+
+func TestHandleDequeueOffice(t *testing.T) {
+	t.Setenv("OFFICES_JSON", `{"+14155550123": {"forward_numbers": "+14155550111"}}`)
+	cfg := testConfig(t)
+
+	tests := []struct {
+		name   string
+		called string
+		want   string
+	}{
+		{"office's staff", "+14155550123", "<Queue"},
+		{"another office's staff", "+14155550199", "<Reject"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handleDequeue(cfg)(w, postForm("/dequeue", url.Values{"From": {"+14155550111"}, "To": {tt.called}}))
+
+			if body := w.Body.String(); !strings.Contains(body, tt.want) {
+				t.Errorf("TwiML has no %s: %s", tt.want, body)
+			}
+		})
+	}
+}
+
+func TestLoadConfigQueue(t *testing.T) {
+	tests := []struct {
+		name          string
+		useQueue      string
+		useConference string
+	}{
+		{"not a boolean", "sometimes", "false"},
+		{"with a conference", "true", "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MY_PHONE_NUMBER", "+14155550100")
+			t.Setenv("TWILIO_PHONE_NUMBER", "+14155550199")
+			t.Setenv("HOLIDAYS_FILE", filepath.Join(t.TempDir(), "holidays.json"))
+			t.Setenv("USE_QUEUE", tt.useQueue)
+			t.Setenv("USE_CONFERENCE", tt.useConference)
+
+			_, err := loadConfig()
+			if err == nil || !strings.Contains(err.Error(), "USE_QUEUE") {
+				t.Errorf("got error %v for USE_QUEUE %q and USE_CONFERENCE %q, want one about USE_QUEUE", err, tt.useQueue, tt.useConference)
+			}
+		})
+	}
+}
+
+func TestHandleConfig(t *testing.T) {
+	t.Setenv("TWILIO_AUTH_TOKEN", "secret-token")
+	t.Setenv("FORWARD_NUMBERS", "+14155550101,+14155550102")
+	t.Setenv("RING_STRATEGY", ringSimultaneous)
+	t.Setenv("SCREEN_CALLERS", "true")
+	t.Setenv("USE_QUEUE", "true")
+	t.Setenv("QUEUE_NAME", "sales")
+	t.Setenv("VACATION_START", "2024-07-02")
+	t.Setenv("VACATION_END", "2024-07-04")
+	t.Setenv("OFFICES_JSON", `{"+14155550123": {"timezone": "America/New_York", "forward_numbers": "+14155550111"}}`)
+	cfg := testConfig(t)
+
+	w := httptest.NewRecorder()
+	handleConfig(cfg)(w, httptest.NewRequest(http.MethodGet, "/config", nil))
+
+	if strings.Contains(w.Body.String(), "secret-token") {
+		t.Errorf("config includes the auth token: %s", w.Body.String())
+	}
+	var got effectiveConfig
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("could not decode the config: %v", err)
+	}
+	if got.RingStrategy != ringSimultaneous || !got.ScreenCallers || got.UseConference || !got.UseQueue || got.QueueName != "sales" {
+		t.Errorf("got ring strategy %q, screen callers %t, use conference %t, use queue %t, queue %q, want %q, true, false, true, %q",
+			got.RingStrategy, got.ScreenCallers, got.UseConference, got.UseQueue, got.QueueName, ringSimultaneous, "sales")
+	}
+	if got.VacationStart != "2024-07-02T00:00:00Z" || got.VacationEnd == "" {
+		t.Errorf("got vacation from %q to %q, want it from 2024-07-02T00:00:00Z", got.VacationStart, got.VacationEnd)
+	}
+	office, ok := got.Offices["+14155550123"]
+	if !ok {
+		t.Fatalf("config doesn't include the office: %+v", got.Offices)
+	}
+	if want := []string{"+*********11"}; office.Timezone != "America/New_York" || !slices.Equal(office.ForwardNumbers, want) {
+		t.Errorf("got office timezone %q and forward numbers %q, want America/New_York and %q", office.Timezone, office.ForwardNumbers, want)
+	}
+	if !office.ScreenCallers {
+		t.Error("office doesn't inherit SCREEN_CALLERS")
+	}
+}
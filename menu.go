@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/twilio/twilio-go/twiml"
+)
+
+// menuOption is an option in the IVR menu, which forwards the call to Number
+// when the caller presses its key
+type menuOption struct {
+	Label  string `json:"label"`
+	Number string `json:"number"`
+}
+
+// parseMenuOptions parses a JSON object, keyed by the key to press, e.g.,
+// {"1": {"label": "sales", "number": "+14155552671"}}, into menu options
+func parseMenuOptions(value string) (map[string]menuOption, error) {
+	var options map[string]menuOption
+	if err := json.Unmarshal([]byte(value), &options); err != nil {
+		return nil, err
+	}
+
+	for key, option := range options {
+		if len(key) != 1 || !strings.Contains("0123456789*#", key) {
+			return nil, fmt.Errorf("menu key %q must be a single digit, * or #", key)
+		}
+		if option.Label == "" {
+			return nil, fmt.Errorf("menu option %s has no label", key)
+		}
+		number, err := normalizeForwardTarget(option.Number)
+		if err != nil {
+			return nil, fmt.Errorf("menu option %s is invalid: %s", key, err)
+		}
+		option.Number = number
+		options[key] = option
+	}
+
+	return options, nil
+}
+
+// menuPrompt builds the message read to callers, listing each option in key
+// order, e.g., "For sales, press 1. For support, press 2.", followed by the
+// callback option, if MENU_CALLBACK_KEY is set
+func menuPrompt(options map[string]menuOption) string {
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	prompts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		prompts = append(prompts, fmt.Sprintf("For %s, press %s.", options[key].Label, key))
+	}
+	if key := callbackKey(); key != "" {
+		prompts = append(prompts, fmt.Sprintf("To be called back, press %s.", key))
+	}
+	return strings.Join(prompts, " ")
+}
+
+// handleMenu presents callers with an IVR menu, configured by MENU_OPTIONS,
+// and sends the key they press to /handle-key. If the caller doesn't press a
+// key, the call goes to voicemail.
+func handleMenu(cfg config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		options, err := parseMenuOptions(getEnv("MENU_OPTIONS", "{}"))
+		if err != nil {
+			appError(w, fmt.Errorf("could not parse MENU_OPTIONS. reason: %s", err))
+			return
+		}
+
+		gather := &twiml.VoiceGather{
+			Action:    publicURL("/handle-key"),
+			NumDigits: "1",
+			Timeout:   strconv.Itoa(cfg.menuTimeout),
+			InnerElements: []twiml.Element{
+				greetingElement(getEnv("MENU_PROMPT", menuPrompt(options))),
+			},
+		}
+		twimlResult, err := twiml.Voice([]twiml.Element{gather, voicemailRedirect("")})
+		if err != nil {
+			appError(w, fmt.Errorf("could not present menu. reason: %s", err))
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/xml")
+		w.Write([]byte(twimlResult))
+	}
+}
+
+// handleMenuKey forwards the call to the number of the menu option which the
+// caller chose, or, if they pressed MENU_CALLBACK_KEY, asks them for a number
+// to call them back on. If they pressed a key which doesn't match an option,
+// the call goes to voicemail, if limiter allows it.
+func handleMenuKey(cfg config, limiter *rateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		options, err := parseMenuOptions(getEnv("MENU_OPTIONS", "{}"))
+		if err != nil {
+			appError(w, fmt.Errorf("could not parse MENU_OPTIONS. reason: %s", err))
+			return
+		}
+
+		logger := requestLogger(r).With("caller", r.FormValue("From"), "digits", r.FormValue("Digits"))
+
+		var elements []twiml.Element
+		option, ok := options[r.FormValue("Digits")]
+		if key := callbackKey(); key != "" && r.FormValue("Digits") == key {
+			elements = callbackNumberElements(cfg, callbackPrompt, 1)
+			logger.Info("Caller asked to be called back")
+		} else if ok {
+			elements = forwardElements(cfg, []string{option.Number}, r.FormValue("From"), ringSequential)
+			callsTotal.WithLabelValues("forward").Inc()
+			logger.Info("Routing call", "decision", "forward", "option", option.Label)
+		} else {
+			elements = limiter.voicemail(r.Context(), cfg, "", r.FormValue("From"), r.FormValue("To"))
+			callsTotal.WithLabelValues("voicemail").Inc()
+			logger.Info("Routing call", "decision", "voicemail")
+		}
+
+		twimlResult, err := twiml.Voice(elements)
+		if err != nil {
+			appError(w, fmt.Errorf("could not handle menu choice. reason: %s", err))
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/xml")
+		w.Write([]byte(twimlResult))
+	}
+}
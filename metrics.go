@@ -0,0 +1,53 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// callsTotal counts incoming calls by how they were routed, either
+	// "forward", "screen", "queue", "conference", "on_call", "voicemail",
+	// "callback", "blocked", "rate_limited", "busy", or "fallback", when an
+	// internal error sent the call to voicemail
+	callsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "calls_total",
+		Help: "The number of incoming calls, by routing decision.",
+	}, []string{"decision"})
+
+	// smsSentTotal counts voicemail SMS notifications by the status Twilio
+	// returned, or "error" or "timeout" if the request to Twilio failed
+	smsSentTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sms_sent_total",
+		Help: "The number of voicemail SMS notifications sent, by status.",
+	}, []string{"status"})
+
+	// notificationFailuresTotal counts voicemails which at least one recipient
+	// wasn't notified of, by channel, e.g., "sms" or "slack", for alerting
+	notificationFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notification_failures_total",
+		Help: "The number of voicemails which could not be notified to every recipient, by channel.",
+	}, []string{"channel"})
+
+	// duplicateCallbacksTotal counts voicemail callbacks, by route, which
+	// repeated one already received, and so were acknowledged without being
+	// handled again
+	duplicateCallbacksTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "duplicate_callbacks_total",
+		Help: "The number of duplicate voicemail callbacks from Twilio, by route.",
+	}, []string{"route"})
+
+	// recordingArchiveFailuresTotal counts recordings which could not be copied
+	// to RECORDING_S3_BUCKET
+	recordingArchiveFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "recording_archive_failures_total",
+		Help: "The number of recordings which could not be archived to S3.",
+	})
+
+	// twilioAPIDuration measures how long requests to the Twilio API take
+	twilioAPIDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "twilio_api_request_duration_seconds",
+		Help:    "How long requests to the Twilio API take, by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+)
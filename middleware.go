@@ -0,0 +1,18 @@
+package main
+
+import "net/http"
+
+// middleware wraps a route's handler with behaviour which several routes
+// share, such as validateTwilioSignature or requireAdminToken
+type middleware func(next http.HandlerFunc) http.HandlerFunc
+
+// chain composes middlewares into one, which runs them in the order given, so
+// that chain(a, b)(h) is a(b(h)), and a sees each request first
+func chain(middlewares ...middleware) middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](next)
+		}
+		return next
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// recordingMiddleware returns middleware which appends name to calls before
+// passing the request on, and name+" done" after
+func recordingMiddleware(name string, calls *[]string) middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			*calls = append(*calls, name)
+			next(w, r)
+			*calls = append(*calls, name+" done")
+		}
+	}
+}
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+	handler := chain(recordingMiddleware("a", &calls), recordingMiddleware("b", &calls), recordingMiddleware("c", &calls))(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, "handler")
+	})
+
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	want := []string{"a", "b", "c", "handler", "c done", "b done", "a done"}
+	if !slices.Equal(calls, want) {
+		t.Errorf("got %q, want %q", calls, want)
+	}
+}
+
+func TestChainEmpty(t *testing.T) {
+	called := false
+	handler := chain()(func(w http.ResponseWriter, r *http.Request) { called = true })
+
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if !called {
+		t.Error("chain() didn't call the handler")
+	}
+}
+
+func TestChainStops(t *testing.T) {
+	var calls []string
+	reject := func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		}
+	}
+	handler := chain(recordingMiddleware("a", &calls), reject, recordingMiddleware("c", &calls))(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, "handler")
+	})
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if want := []string{"a", "a done"}; !slices.Equal(calls, want) {
+		t.Errorf("got %q, want %q", calls, want)
+	}
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
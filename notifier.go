@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// defaultNotifyTimeLayout is the layout in which notifications show when a
+// voicemail was received, unless NOTIFY_TIME_FORMAT is set, e.g., "Mon Jan 2
+// 2006, 3:04 PM CEST"
+const defaultNotifyTimeLayout = "Mon Jan 2 2006, 3:04 PM MST"
+
+// voicemailEvent is a voicemail which notifiers tell staff about
+type voicemailEvent struct {
+	Caller string `json:"caller"`
+	// CallerName is the caller's name, from CALLER_NAME_LOOKUP, if known
+	CallerName    string        `json:"caller_name,omitempty"`
+	Transcription string        `json:"transcription"`
+	RecordingURL  string        `json:"recording_url"`
+	ReceivedAt    time.Time     `json:"received_at"`
+	Reason        routingReason `json:"reason,omitempty"`
+	Language      string        `json:"language,omitempty"`
+	CallSID       string        `json:"call_sid"`
+	// TranscriptionPending is true if the voicemail has only just been
+	// recorded, and its transcription will follow in another notification
+	TranscriptionPending bool `json:"transcription_pending,omitempty"`
+
+	// timeLayout is the layout in which received shows ReceivedAt
+	timeLayout string
+	// followUp is true if notifiers were already sent the recording, by
+	// handleRecordingStatus, so notifications only need to add its
+	// transcription
+	followUp bool
+}
+
+// received returns when the voicemail was received, in the timezone of
+// ReceivedAt, e.g., "Mon Jun 3 2024, 2:15 PM CDT"
+func (e voicemailEvent) received() string {
+	layout := e.timeLayout
+	if layout == "" {
+		layout = defaultNotifyTimeLayout
+	}
+	return e.ReceivedAt.Format(layout)
+}
+
+// summary composes the text of a notification of the voicemail, as sent by
+// SMS and to Slack. If includeReason is true, it starts with why the call went
+// to voicemail. Otherwise, it starts with who the caller is, if known. If the
+// transcription is pending, it says that it will follow, and if staff were
+// already sent the recording, only its transcription is included. It ends with
+// when the voicemail was received, and the CallSid, for finding the call in
+// the Twilio Console.
+func (e voicemailEvent) summary(includeReason bool) string {
+	body := voicemailMessage(e.Transcription, e.RecordingURL)
+	switch {
+	case e.TranscriptionPending:
+		body = "Voicemail received, the transcription will follow."
+		if e.RecordingURL != "" {
+			body = fmt.Sprintf("%s\n\nListen: %s", body, e.RecordingURL)
+		}
+	case e.followUp:
+		body = fmt.Sprintf("Transcription of the voicemail received earlier:\n\n%s", e.Transcription)
+	}
+	if !e.ReceivedAt.IsZero() {
+		body = fmt.Sprintf("%s\n\nReceived: %s", body, e.received())
+	}
+	if e.Language != "" {
+		body = fmt.Sprintf("%s\n\nLanguage: %s", body, e.Language)
+	}
+	if e.CallSID != "" {
+		body = fmt.Sprintf("%s\n\nCall: %s", body, e.CallSID)
+	}
+
+	caller := e.Caller
+	if e.CallerName != "" {
+		caller = fmt.Sprintf("%s (%s)", e.CallerName, e.Caller)
+	}
+	switch {
+	case includeReason && e.Reason.description() != "" && caller == "":
+		return fmt.Sprintf("%s voicemail:\n\n%s", e.Reason.description(), body)
+	case includeReason && e.Reason.description() != "":
+		return fmt.Sprintf("%s voicemail from %s:\n\n%s", e.Reason.description(), caller, body)
+	case caller == "":
+		return body
+	default:
+		return fmt.Sprintf("Voicemail from %s:\n\n%s", caller, body)
+	}
+}
+
+// notifier tells staff about voicemails over a single channel, such as SMS
+type notifier interface {
+	// channel names the channel, e.g., "sms", for logs and metrics
+	channel() string
+	notify(ctx context.Context, event voicemailEvent) error
+}
+
+// notifyAll sends event to each of notifiers at once, logging and counting
+// those which fail, so that a failure on one channel doesn't stop the others
+func notifyAll(ctx context.Context, notifiers []notifier, event voicemailEvent) {
+	var wg sync.WaitGroup
+	for _, n := range notifiers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := n.notify(ctx, event); err != nil {
+				notificationFailuresTotal.WithLabelValues(n.channel()).Inc()
+				contextLogger(ctx).Error("Could not send voicemail notification", "channel", n.channel(), "error", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// newNotifiers returns the notifiers enabled by the configuration: email, if
+// newEmailNotifier returns one, Slack, if SLACK_WEBHOOK_URL is set, a generic
+// webhook, if NOTIFY_WEBHOOK_URL is set, and SMS, using sender, unless
+// NOTIFY_SMS is false and there is at least one other notifier
+func newNotifiers(cfg config, sender messageSender) []notifier {
+	var notifiers []notifier
+	if email := newEmailNotifier(cfg.apiTimeout); email != nil {
+		notifiers = append(notifiers, email)
+	}
+	client := &http.Client{Timeout: cfg.apiTimeout}
+	if url := os.Getenv("SLACK_WEBHOOK_URL"); url != "" {
+		notifiers = append(notifiers, &slackNotifier{client: client, url: url, includeReason: cfg.includeReason})
+	}
+	if url := os.Getenv("NOTIFY_WEBHOOK_URL"); url != "" {
+		notifiers = append(notifiers, &webhookNotifier{client: client, url: url})
+	}
+	if cfg.notifySMS || len(notifiers) == 0 {
+		notifiers = append(notifiers, &smsNotifier{
+			sender:        sender,
+			from:          cfg.twilioPhoneNumber,
+			recipients:    cfg.notifyNumbers,
+			timeout:       cfg.apiTimeout,
+			retry:         cfg.retry,
+			includeReason: cfg.includeReason,
+
+			maxTranscriptionLength: cfg.smsMaxTranscriptionLength,
+		})
+	}
+	return notifiers
+}
+
+// smsNotifier sends voicemail notifications by SMS, from the Twilio number
+// from, to each of recipients
+type smsNotifier struct {
+	sender        messageSender
+	from          string
+	recipients    []string
+	timeout       time.Duration
+	retry         retryPolicy
+	includeReason bool
+	// maxTranscriptionLength is the most characters of the transcription to
+	// send, or 0 to send all of it
+	maxTranscriptionLength int
+}
+
+// channel returns "sms"
+func (n *smsNotifier) channel() string { return "sms" }
+
+// notify sends the voicemail's summary to each recipient, with the
+// transcription cut to maxTranscriptionLength. A failure to send to one
+// recipient doesn't stop the others being sent, but is reported.
+func (n *smsNotifier) notify(ctx context.Context, event voicemailEvent) error {
+	logger := contextLogger(ctx).With("caller", event.Caller, "reason", event.Reason)
+	event.Transcription = truncateTranscription(event.Transcription, n.maxTranscriptionLength)
+	body := event.summary(n.includeReason)
+
+	var failed []string
+	for _, recipient := range n.recipients {
+		_, err := sendVoicemailSMS(ctx, n.sender, recipient, n.from, body, n.timeout, n.retry, logger.With("recipient", recipient))
+		if err != nil {
+			failed = append(failed, recipient)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("could not send SMS to %d of %d recipients: %v", len(failed), len(n.recipients), failed)
+	}
+	return nil
+}
+
+// truncatedSuffix is appended to transcriptions which are cut short
+const truncatedSuffix = "…(truncated)"
+
+// truncateTranscription cuts transcription to at most limit characters, rather
+// than bytes, so that multi-byte characters aren't split, ending it with
+// truncatedSuffix. If limit is 0, or the transcription is no longer than it,
+// it is returned as is.
+func truncateTranscription(transcription string, limit int) string {
+	if limit <= 0 || utf8.RuneCountInString(transcription) <= limit {
+		return transcription
+	}
+	runes := []rune(transcription)
+	return strings.TrimRightFunc(string(runes[:limit]), unicode.IsSpace) + truncatedSuffix
+}
+
+// postJSON posts v, as JSON, to url using client, returning an error unless
+// the response is a 2xx
+func postJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded with %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
+
+// slackNotifier posts voicemail notifications to a Slack incoming webhook
+type slackNotifier struct {
+	client        *http.Client
+	url           string
+	includeReason bool
+}
+
+// channel returns "slack"
+func (n *slackNotifier) channel() string { return "slack" }
+
+// notify posts the voicemail's summary to the Slack channel
+func (n *slackNotifier) notify(ctx context.Context, event voicemailEvent) error {
+	return postJSON(ctx, n.client, n.url, map[string]string{"text": event.summary(n.includeReason)})
+}
+
+// webhookNotifier posts each voicemail, as a JSON voicemailEvent, to a URL
+type webhookNotifier struct {
+	client *http.Client
+	url    string
+}
+
+// channel returns "webhook"
+func (n *webhookNotifier) channel() string { return "webhook" }
+
+// notify posts event to the webhook
+func (n *webhookNotifier) notify(ctx context.Context, event voicemailEvent) error {
+	return postJSON(ctx, n.client, n.url, event)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	lookups "github.com/twilio/twilio-go/rest/lookups/v2"
+)
+
+func TestTruncateTranscription(t *testing.T) {
+	tests := []struct {
+		name          string
+		transcription string
+		limit         int
+		want          string
+	}{
+		{"no limit", "Please call me back.", 0, "Please call me back."},
+		{"shorter", "Please call me back.", 25, "Please call me back."},
+		{"exactly the limit", "Please call me back.", 20, "Please call me back."},
+		{"one over", "Please call me back.", 19, "Please call me back" + truncatedSuffix},
+		{"trailing space", "Please call me back.", 7, "Please" + truncatedSuffix},
+		{"multi-byte characters", "Bitte zurückrufen, danke.", 12, "Bitte zurück" + truncatedSuffix},
+		{"emoji", "Call me 📞📞📞", 9, "Call me 📞" + truncatedSuffix},
+		{"empty", "", 10, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateTranscription(tt.transcription, tt.limit)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("got %q, which isn't valid UTF-8", got)
+			}
+		})
+	}
+}
+
+func TestSMSNotifierTruncatesTranscription(t *testing.T) {
+	sender := &fakeSender{status: "queued"}
+	n := &smsNotifier{
+		sender:                 sender,
+		from:                   "+14155550199",
+		recipients:             []string{"+14155550100"},
+		timeout:                time.Second,
+		retry:                  noRetry,
+		maxTranscriptionLength: 10,
+	}
+	event := voicemailEvent{
+		Caller:        "+14155552671",
+		Transcription: "Hi, it's Sam, please call me back about the invoice.",
+		RecordingURL:  "https://api.twilio.com/recording",
+	}
+
+	if err := n.notify(context.Background(), event); err != nil {
+		t.Fatalf("notify returned %v", err)
+	}
+	sent := sender.messages()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(sent))
+	}
+	body := *sent[0].Body
+	if !strings.Contains(body, "Hi, it's S"+truncatedSuffix) || strings.Contains(body, "invoice") {
+		t.Errorf("SMS doesn't have the truncated transcription: %q", body)
+	}
+	if !strings.Contains(body, event.RecordingURL) {
+		t.Errorf("SMS doesn't link to the recording: %q", body)
+	}
+}
+
+// fakeNotifier records the events it is sent, and fails with err, if set
+type fakeNotifier struct {
+	name   string
+	err    error
+	mu     sync.Mutex
+	events []voicemailEvent
+}
+
+func (n *fakeNotifier) channel() string { return n.name }
+
+func (n *fakeNotifier) notify(ctx context.Context, event voicemailEvent) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.events = append(n.events, event)
+	return n.err
+}
+
+func TestHandleTestNotification(t *testing.T) {
+	cfg := testConfig(t)
+	sender := &fakeSender{status: "queued"}
+	sms := &smsNotifier{sender: sender, from: cfg.twilioPhoneNumber, recipients: cfg.notifyNumbers, timeout: time.Second, retry: noRetry}
+	slack := &fakeNotifier{name: "slack"}
+	email := &fakeNotifier{name: "email", err: errors.New("could not send email")}
+
+	w := httptest.NewRecorder()
+	handleTestNotification([]notifier{sms, slack, email}, cfg)(w, httptest.NewRequest(http.MethodPost, "/test-notification", nil))
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("got status %d, want %d, as the email failed", w.Code, http.StatusBadGateway)
+	}
+	if sent := sender.messages(); len(sent) != len(cfg.notifyNumbers) || !strings.Contains(*sent[0].Body, "This is a test voicemail notification.") {
+		t.Errorf("test SMS wasn't sent to each notified number: %d messages", len(sent))
+	}
+	for _, n := range []*fakeNotifier{slack, email} {
+		if len(n.events) != 1 || n.events[0].Transcription != "This is a test voicemail notification." {
+			t.Errorf("%s wasn't sent the test voicemail: %+v", n.name, n.events)
+		}
+	}
+
+	var body struct {
+		Results []testNotificationResult `json:"results"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("could not decode the response: %v", err)
+	}
+	want := []testNotificationResult{{Channel: "sms"}, {Channel: "slack"}, {Channel: "email", Error: "could not send email"}}
+	if !slices.Equal(body.Results, want) {
+		t.Errorf("got results %+v, want %+v", body.Results, want)
+	}
+}
+
+func TestEmailNotifierTimeout(t *testing.T) {
+	// A server which accepts connections, but never greets the client
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	n := &emailNotifier{host: "127.0.0.1", addr: listener.Addr().String(), from: "voicemail@example.com", to: []string{"staff@example.com"}, timeout: 50 * time.Millisecond}
+	start := time.Now()
+	if err := n.notify(context.Background(), voicemailEvent{Caller: "+14155552671"}); err == nil {
+		t.Error("notify returned no error for an unresponsive server")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("notify took %s, want it to give up after the timeout", elapsed)
+	}
+}
+
+// fakeLooker returns name for every number, counting its lookups
+type fakeLooker struct {
+	name    string
+	lookups atomic.Int32
+}
+
+func (l *fakeLooker) FetchPhoneNumber(phoneNumber string, params *lookups.FetchPhoneNumberParams) (*lookups.LookupsV2PhoneNumber, error) {
+	l.lookups.Add(1)
+	var callerName interface{} = map[string]interface{}{"caller_name": l.name}
+	return &lookups.LookupsV2PhoneNumber{CallerName: &callerName}, nil
+}
+
+func TestCallerNamesCache(t *testing.T) {
+	looker := &fakeLooker{name: "SAM SMITH"}
+	names := &callerNames{looker: looker, timeout: time.Second, ttl: time.Hour, cache: map[string]cachedCallerName{}}
+	now := time.Date(2024, time.June, 12, 10, 0, 0, 0, time.UTC)
+	pinClock(t, now)
+
+	for range 2 {
+		if got := names.lookup(context.Background(), "+14155552671", discardLogger()); got != "SAM SMITH" {
+			t.Errorf("got %q, want %q", got, "SAM SMITH")
+		}
+	}
+	if got := looker.lookups.Load(); got != 1 {
+		t.Errorf("looked up %d times, want 1, with the second from the cache", got)
+	}
+
+	// Once the first caller's name expires, looking up another caller
+	// deletes it, rather than keeping it forever
+	pinClock(t, now.Add(time.Hour))
+	names.lookup(context.Background(), "+14155552672", discardLogger())
+	if _, ok := names.cache["+14155552671"]; ok {
+		t.Error("expired caller name wasn't deleted from the cache")
+	}
+	if len(names.cache) != 1 {
+		t.Errorf("cache has %d names, want 1", len(names.cache))
+	}
+
+	names.lookup(context.Background(), "+14155552671", discardLogger())
+	if got := looker.lookups.Load(); got != 3 {
+		t.Errorf("looked up %d times, want 3, with the expired name looked up again", got)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// officeSettings are the settings of one office, in OFFICES_JSON, which
+// override the application-wide ones for calls to its Twilio number. Settings
+// which are left out are the same as for the rest of the application.
+type officeSettings struct {
+	Timezone       string          `json:"timezone"`
+	WorkWeekStart  string          `json:"work_week_start"`
+	WorkWeekEnd    string          `json:"work_week_end"`
+	WorkDayHours   string          `json:"work_day_hours"`
+	WorkHours      json.RawMessage `json:"work_hours"`
+	ClosedDays     string          `json:"closed_days"`
+	Holidays       string          `json:"holidays"`
+	ForwardNumbers string          `json:"forward_numbers"`
+}
+
+// apply returns a copy of base with the settings, which are in the same
+// formats as their environment variables, applied
+func (s officeSettings) apply(base config) (config, error) {
+	cfg := base
+	cfg.offices = nil
+	var err error
+
+	if s.Timezone != "" {
+		if cfg.location, err = time.LoadLocation(s.Timezone); err != nil {
+			return cfg, fmt.Errorf("invalid timezone: %s", err)
+		}
+	}
+	if s.WorkWeekStart != "" {
+		if cfg.workWeekStart, err = parseWeekday(s.WorkWeekStart); err != nil {
+			return cfg, fmt.Errorf("invalid work_week_start: %s", err)
+		}
+	}
+	if s.WorkWeekEnd != "" {
+		if cfg.workWeekEnd, err = parseWeekday(s.WorkWeekEnd); err != nil {
+			return cfg, fmt.Errorf("invalid work_week_end: %s", err)
+		}
+	}
+	if s.WorkDayHours != "" {
+		if cfg.workDayHours, err = parseOpeningHours(s.WorkDayHours); err != nil {
+			return cfg, fmt.Errorf("invalid work_day_hours: %s", err)
+		}
+	}
+	if len(s.WorkHours) > 0 {
+		if cfg.workHours, err = parseSchedule(string(s.WorkHours)); err != nil {
+			return cfg, fmt.Errorf("invalid work_hours: %s", err)
+		}
+	}
+	if s.ClosedDays != "" {
+		if cfg.closedDays, err = parseClosedDays(splitList(s.ClosedDays)); err != nil {
+			return cfg, fmt.Errorf("invalid closed_days: %s", err)
+		}
+	}
+	if s.Holidays != "" {
+		if cfg.holidays, err = parseHolidays(splitList(s.Holidays)); err != nil {
+			return cfg, fmt.Errorf("invalid holidays: %s", err)
+		}
+	}
+	if s.ForwardNumbers != "" {
+		if cfg.forwardNumbers, err = normalizeList(s.ForwardNumbers, normalizeForwardTarget); err != nil {
+			return cfg, fmt.Errorf("invalid forward_numbers: %s", err)
+		}
+		// The application-wide FORWARD_SCHEDULE is for its own numbers
+		cfg.forwardWindows = nil
+	}
+
+	return cfg, nil
+}
+
+// parseOffices parses a JSON object of office settings, keyed by the Twilio
+// number which each office's callers call, e.g.,
+// {"+14155550100": {"timezone": "America/Los_Angeles", "forward_numbers": "+14155550101"}},
+// into the configuration of each office, based on base
+func parseOffices(value string, base config) (map[string]config, error) {
+	var entries map[string]officeSettings
+	if err := json.Unmarshal([]byte(value), &entries); err != nil {
+		return nil, err
+	}
+
+	offices := make(map[string]config, len(entries))
+	for number, settings := range entries {
+		called, err := normalizeNumber(number)
+		if err != nil {
+			return nil, err
+		}
+		if offices[called], err = settings.apply(base); err != nil {
+			return nil, fmt.Errorf("%s is invalid: %s", number, err)
+		}
+	}
+	return offices, nil
+}
+
+// forCalled returns the configuration for calls to called, the Twilio number
+// that the caller dialled: that of its office, if it has one, or cfg
+// otherwise
+func (cfg config) forCalled(called string) config {
+	if normalized, err := normalizeNumber(called); err == nil {
+		called = normalized
+	}
+	if office, ok := cfg.offices[called]; ok {
+		return office
+	}
+	return cfg
+}
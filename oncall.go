@@ -0,0 +1,26 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// onCallNumber returns the number to forward after-hours calls to at now, or
+// an empty string if after-hours calls should go straight to voicemail. If
+// ON_CALL_ROTATION is set, its numbers take turns being on call, changing
+// every week, counted from midnight, in now's timezone, on the date in
+// ON_CALL_ROTATION_START. Otherwise, AFTER_HOURS_FORWARD is used.
+func onCallNumber(cfg config, now time.Time) string {
+	if len(cfg.onCallRotation) == 0 {
+		return cfg.afterHoursForward
+	}
+
+	year, month, day := cfg.onCallRotationStart.Date()
+	start := time.Date(year, month, day, 0, 0, 0, 0, now.Location())
+	weeks := int(math.Floor(now.Sub(start).Hours() / (24 * 7)))
+	index := weeks % len(cfg.onCallRotation)
+	if index < 0 {
+		index += len(cfg.onCallRotation)
+	}
+	return cfg.onCallRotation[index]
+}
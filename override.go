@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// overrideMode is how, if at all, the business hours have been overridden by
+// an admin
+type overrideMode string
+
+const (
+	overrideNone      overrideMode = ""
+	overrideVoicemail overrideMode = "voicemail"
+	overrideOpen      overrideMode = "open"
+)
+
+// hoursOverride holds an admin's override of the business hours, e.g., to send
+// every call to voicemail during an all-hands, until it is cleared. It is kept
+// in store, so it applies to every replica, though an in-memory store reverts
+// to the schedule on restart. A nil *hoursOverride never overrides anything.
+type hoursOverride struct {
+	store stateStore
+}
+
+// overrideKey is the key under which the override mode is kept in the store
+const overrideKey = "override"
+
+// newHoursOverride returns an override, kept in store, which follows the
+// schedule until set
+func newHoursOverride(store stateStore) *hoursOverride {
+	return &hoursOverride{store: store}
+}
+
+// current returns the current override mode. If store can't be reached, the
+// error is logged and the schedule is followed.
+func (o *hoursOverride) current(ctx context.Context) overrideMode {
+	if o == nil {
+		return overrideNone
+	}
+
+	mode, err := o.store.get(ctx, overrideKey)
+	if err != nil {
+		contextLogger(ctx).Error("Could not read the business hours override, following the schedule", "error", err)
+		return overrideNone
+	}
+	return overrideMode(mode)
+}
+
+// set changes the override mode, with overrideNone reverting to the schedule
+func (o *hoursOverride) set(ctx context.Context, mode overrideMode) error {
+	return o.store.set(ctx, overrideKey, string(mode), 0)
+}
+
+// apply returns whether the business is open, and why, once m is applied to
+// open and reason, from the schedule
+func (m overrideMode) apply(open bool, reason routingReason) (bool, routingReason) {
+	switch m {
+	case overrideVoicemail:
+		return false, reasonForcedVoicemail
+	case overrideOpen:
+		return true, reasonForcedOpen
+	default:
+		return open, reason
+	}
+}
+
+// handleSetOverride returns a handler which sets override to mode, and reports
+// the new mode as JSON
+func handleSetOverride(override *hoursOverride, mode overrideMode) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := override.set(r.Context(), mode); err != nil {
+			appError(w, fmt.Errorf("could not change the business hours override. reason: %s", err))
+			return
+		}
+		requestLogger(r).Info("Business hours override changed", "override", mode)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]overrideMode{"override": mode})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/nyaruka/phonenumbers"
+)
+
+// defaultRegion returns the region, as a two-letter country code, e.g., US or
+// PL, assumed for phone numbers without a country code, from DEFAULT_REGION
+func defaultRegion() string {
+	return strings.ToUpper(getEnv("DEFAULT_REGION", "US"))
+}
+
+// validateDefaultRegion checks that DEFAULT_REGION is a region which phone
+// numbers can be parsed for
+func validateDefaultRegion() error {
+	if phonenumbers.GetCountryCodeForRegion(defaultRegion()) == 0 {
+		return fmt.Errorf("DEFAULT_REGION must be a two-letter country code, e.g., US, not %q", os.Getenv("DEFAULT_REGION"))
+	}
+	return nil
+}
+
+// normalizeNumber converts number, in any common format, e.g., (555) 123-4567
+// or +1 555.123.4567, into E.164 format, which Twilio requires. Numbers
+// without a country code are taken to be in defaultRegion. The result is
+// checked with validateE164, as that is what Twilio will accept.
+func normalizeNumber(number string) (string, error) {
+	parsed, err := phonenumbers.Parse(number, defaultRegion())
+	if err != nil || phonenumbers.IsPossibleNumberWithReason(parsed) != phonenumbers.IS_POSSIBLE {
+		return "", fmt.Errorf("%q is not a phone number; it must be a phone number, e.g., +14155552671, or, in %s, (415) 555-2671", number, defaultRegion())
+	}
+	normalized := phonenumbers.Format(parsed, phonenumbers.E164)
+	if err := validateE164(normalized); err != nil {
+		return "", err
+	}
+	return normalized, nil
+}
+
+// normalizeForwardTarget normalizes target, which calls are forwarded to, if
+// it is a phone number. SIP URIs are validated, but otherwise left as they
+// are.
+func normalizeForwardTarget(target string) (string, error) {
+	if isSIPURI(target) {
+		return target, validateForwardTarget(target)
+	}
+	return normalizeNumber(target)
+}
+
+// normalizeList applies normalize to each item of the comma-separated list in
+// value, so that numbers can be written however is convenient, e.g., (415)
+// 555-2671
+func normalizeList(value string, normalize func(string) (string, error)) ([]string, error) {
+	items := splitList(value)
+	for i, item := range items {
+		normalized, err := normalize(item)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = normalized
+	}
+	return items, nil
+}
+
+// normalizeEnvList returns the comma-separated list of numbers in the
+// environment variable key, each converted with normalize
+func normalizeEnvList(key string, normalize func(string) (string, error)) ([]string, error) {
+	numbers, err := normalizeList(os.Getenv(key), normalize)
+	if err != nil {
+		return nil, fmt.Errorf("%s is invalid: %s", key, err)
+	}
+	return numbers, nil
+}
+
+// normalizeEnv returns the number in the environment variable key, converted
+// with normalize, or an empty string if it isn't set
+func normalizeEnv(key string, normalize func(string) (string, error)) (string, error) {
+	number := strings.TrimSpace(os.Getenv(key))
+	if number == "" {
+		return "", nil
+	}
+	normalized, err := normalize(number)
+	if err != nil {
+		return "", fmt.Errorf("%s is invalid: %s", key, err)
+	}
+	return normalized, nil
+}
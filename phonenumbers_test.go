@@ -0,0 +1,97 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeNumber(t *testing.T) {
+	tests := []struct {
+		name    string
+		region  string
+		number  string
+		want    string
+		wantErr bool
+	}{
+		{name: "E.164", number: "+14155552671", want: "+14155552671"},
+		{name: "spaces", number: "+1 415 555 2671", want: "+14155552671"},
+		{name: "dashes", number: "415-555-2671", want: "+14155552671"},
+		{name: "parentheses", number: "(415) 555-2671", want: "+14155552671"},
+		{name: "dots", number: "+1 415.555.2671", want: "+14155552671"},
+		{name: "leading 00", region: "GB", number: "0048 22 123 45 67", want: "+48221234567"},
+		{name: "national format", region: "GB", number: "020 7946 0018", want: "+442079460018"},
+		{name: "national format in another region", region: "PL", number: "22 123 45 67", want: "+48221234567"},
+		{name: "too short", number: "555-267", wantErr: true},
+		{name: "letters", number: "call me", wantErr: true},
+		{name: "empty", number: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			region := tt.region
+			if region == "" {
+				region = "US"
+			}
+			t.Setenv("DEFAULT_REGION", region)
+
+			got, err := normalizeNumber(tt.number)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizeNumber(%q) returned %v, want error: %t", tt.number, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigNormalizesNumbers(t *testing.T) {
+	t.Setenv("FORWARD_NUMBERS", "(415) 555-0101, sip:reception@pbx.example.com")
+	t.Setenv("NOTIFY_NUMBERS", "415-555-0102")
+	t.Setenv("CALLER_ID", "+1 415 555 0199")
+	t.Setenv("AFTER_HOURS_FORWARD", "415.555.0103")
+	cfg := testConfig(t)
+
+	if want := []string{"+14155550101", "sip:reception@pbx.example.com"}; !slices.Equal(cfg.forwardNumbers, want) {
+		t.Errorf("got forward numbers %q, want %q", cfg.forwardNumbers, want)
+	}
+	if want := []string{"+14155550102"}; !slices.Equal(cfg.notifyNumbers, want) {
+		t.Errorf("got notify numbers %q, want %q", cfg.notifyNumbers, want)
+	}
+	if cfg.callerID != "+14155550199" {
+		t.Errorf("got caller ID %q, want %q", cfg.callerID, "+14155550199")
+	}
+	if cfg.afterHoursForward != "+14155550103" {
+		t.Errorf("got after-hours number %q, want %q", cfg.afterHoursForward, "+14155550103")
+	}
+}
+
+func TestLoadConfigInvalidNumbers(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		env  map[string]string
+	}{
+		{name: "forward number", key: "FORWARD_NUMBERS", env: map[string]string{"FORWARD_NUMBERS": "+14155550101,not a number"}},
+		{name: "notify number", key: "NOTIFY_NUMBERS", env: map[string]string{"NOTIFY_NUMBERS": "sip:reception@pbx.example.com"}},
+		{name: "SIP URI without notify numbers", key: "NOTIFY_NUMBERS", env: map[string]string{"MY_PHONE_NUMBER": "sip:reception@pbx.example.com"}},
+		{name: "default region", key: "DEFAULT_REGION", env: map[string]string{"DEFAULT_REGION": "XX"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MY_PHONE_NUMBER", "+14155550100")
+			t.Setenv("TWILIO_PHONE_NUMBER", "+14155550199")
+			t.Setenv("HOLIDAYS_FILE", filepath.Join(t.TempDir(), "holidays.json"))
+			unsetenv(t, "NOTIFY_NUMBERS")
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			_, err := loadConfig()
+			if err == nil || !strings.Contains(err.Error(), tt.key) {
+				t.Errorf("got %v, want an error about %s", err, tt.key)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+
+	"github.com/twilio/twilio-go/twiml"
+)
+
+// queueElements returns the TwiML which places the call in cfg's call queue,
+// where the caller hears QUEUE_WAIT_URL, or Twilio's hold music if it isn't
+// set. If the caller leaves the queue without being answered, Twilio requests
+// /queue-status, which sends them to voicemail for reason.
+func queueElements(cfg config, reason routingReason) []twiml.Element {
+	enqueue := &twiml.VoiceEnqueue{
+		Name:         cfg.queueName,
+		Action:       publicURL("/queue-status?" + url.Values{"reason": {string(reason)}}.Encode()),
+		WaitUrl:      os.Getenv("QUEUE_WAIT_URL"),
+		MaxQueueSize: os.Getenv("QUEUE_MAX_SIZE"),
+	}
+	return append(holdElements(), enqueue)
+}
+
+// handleQueueStatus is requested by Twilio once a caller leaves the call
+// queue. If they were connected, or hung up, the call is over. Otherwise,
+// e.g., if the queue was full, the caller is sent to voicemail, if limiter
+// allows it, so that they can still leave a message.
+func handleQueueStatus(cfg config, limiter *rateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result := r.FormValue("QueueResult")
+		logger := requestLogger(r).With("caller", r.FormValue("From"), "queue_result", result)
+
+		elements := []twiml.Element{&twiml.VoiceHangup{}}
+		switch result {
+		case "bridged", "bridging-in-process", "hangup", "redirected":
+		default:
+			reason := routingReason(r.URL.Query().Get("reason"))
+			logger.Info("Queued call was not answered, sending it to voicemail", "reason", reason)
+			elements = limiter.voicemail(r.Context(), cfg, reason, r.FormValue("From"), r.FormValue("To"))
+		}
+
+		twimlResult, err := twiml.Voice(elements)
+		if err != nil {
+			appError(w, fmt.Errorf("could not handle the queued call ending. reason: %s", err))
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/xml")
+		w.Write([]byte(twimlResult))
+	}
+}
+
+// isStaff reports whether number is one of the forward numbers, at any time
+// of day
+func isStaff(cfg config, number string) bool {
+	staff := slices.Contains(cfg.forwardNumbers, number)
+	for _, window := range cfg.forwardWindows {
+		staff = staff || slices.Contains(window.numbers, number)
+	}
+	return staff
+}
+
+// handleDequeue returns a handler which connects staff, calling from one of
+// the forward numbers of the office that they called, to the caller who has
+// waited longest in its call queue. Calls from any other number are rejected,
+// so that only staff can answer queued calls.
+func handleDequeue(cfg config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := cfg.forCalled(r.FormValue("To"))
+		caller := r.FormValue("From")
+		if normalized, err := normalizeNumber(caller); err == nil {
+			caller = normalized
+		}
+		logger := requestLogger(r).With("caller", caller)
+
+		elements := []twiml.Element{&twiml.VoiceReject{}}
+		if isStaff(cfg, caller) {
+			elements = []twiml.Element{&twiml.VoiceDial{
+				InnerElements: []twiml.Element{&twiml.VoiceQueue{Name: cfg.queueName}},
+			}}
+			logger.Info("Connecting staff to the call queue", "queue", cfg.queueName)
+		} else {
+			logger.Warn("Rejecting dequeue call from a number which isn't one of the forward numbers")
+		}
+
+		twimlResult, err := twiml.Voice(elements)
+		if err != nil {
+			appError(w, fmt.Errorf("could not dequeue call. reason: %s", err))
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/xml")
+		w.Write([]byte(twimlResult))
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/twilio/twilio-go/twiml"
+)
+
+// rateLimiter limits how many times each key, e.g., a caller's number, may do
+// something within a sliding window, keeping count in store, so that the limit
+// applies across replicas. A nil *rateLimiter allows everything.
+type rateLimiter struct {
+	limit  int
+	window time.Duration
+	store  stateStore
+}
+
+// newRateLimiter returns a limiter which allows limit hits per key within
+// window, or nil, allowing everything, if limit is less than 1
+func newRateLimiter(limit int, window time.Duration, store stateStore) *rateLimiter {
+	if limit < 1 {
+		return nil
+	}
+	return &rateLimiter{limit: limit, window: window, store: store}
+}
+
+// allow records a hit for key, and reports whether it is within the limit.
+// Hits over the limit aren't recorded, so that a caller who keeps trying is
+// let through again once their earlier hits leave the window. If store can't
+// be reached, the error is logged and the hit is allowed, so that callers can
+// still leave voicemails.
+func (l *rateLimiter) allow(ctx context.Context, key string) bool {
+	if l == nil {
+		return true
+	}
+
+	allowed, err := l.store.allow(ctx, "rate:"+key, l.limit, l.window)
+	if err != nil {
+		contextLogger(ctx).Error("Could not check the rate limit, allowing the call", "error", err)
+		return true
+	}
+	return allowed
+}
+
+// voicemail returns the TwiML which sends caller, who called called, to
+// voicemail for reason, with voicemailElements, if l allows them another
+// voicemail, or tells them to try again later, with rateLimitedElements,
+// otherwise. Every route to voicemail, other than callError's fallback, goes
+// through it, so that the limit can't be got around by, e.g., letting a
+// forwarded call ring out.
+func (l *rateLimiter) voicemail(ctx context.Context, cfg config, reason routingReason, caller, called string) []twiml.Element {
+	key := caller
+	if normalized, err := normalizeNumber(caller); err == nil {
+		key = normalized
+	}
+	if !l.allow(ctx, key) {
+		callsTotal.WithLabelValues("rate_limited").Inc()
+		contextLogger(ctx).Warn("Routing call", "decision", "rate_limited", "caller", key)
+		return rateLimitedElements()
+	}
+	return voicemailElements(cfg, reason, caller, called)
+}
+
+// rateLimitedElements returns the TwiML for callers who have left too many
+// voicemails recently, which tells them so, with RATE_LIMIT_MESSAGE, and hangs
+// up
+func rateLimitedElements() []twiml.Element {
+	message := getEnv("RATE_LIMIT_MESSAGE", "Sorry, you have left too many messages recently. Please try again later. Goodbye.")
+	return []twiml.Element{
+		greetingElement(message),
+		&twiml.VoiceHangup{},
+	}
+}
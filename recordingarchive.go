@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxPresignedExpiry is the longest that S3 allows a presigned URL to last
+const maxPresignedExpiry = 7 * 24 * time.Hour
+
+// recordingArchive copies voicemail recordings from Twilio to an S3-compatible
+// bucket, so that they are kept even if they are deleted from Twilio
+type recordingArchive struct {
+	client *minio.Client
+	bucket string
+	// linkExpiry is how long the links to archived recordings, which are
+	// included in notifications, last
+	linkExpiry time.Duration
+}
+
+// newRecordingArchive returns a recordingArchive configured from
+// RECORDING_S3_ENDPOINT, RECORDING_S3_BUCKET, RECORDING_S3_ACCESS_KEY,
+// RECORDING_S3_SECRET_KEY, RECORDING_S3_REGION, RECORDING_S3_USE_SSL, and
+// RECORDING_S3_LINK_EXPIRY, or nil if RECORDING_S3_BUCKET is not set
+func newRecordingArchive() (*recordingArchive, error) {
+	bucket := os.Getenv("RECORDING_S3_BUCKET")
+	if bucket == "" {
+		return nil, nil
+	}
+
+	useSSL, err := getEnvBool("RECORDING_S3_USE_SSL", true)
+	if err != nil {
+		return nil, err
+	}
+	linkExpiry, err := getEnvDuration("RECORDING_S3_LINK_EXPIRY", maxPresignedExpiry, time.Second)
+	if err != nil || linkExpiry > maxPresignedExpiry {
+		return nil, fmt.Errorf("RECORDING_S3_LINK_EXPIRY must be a positive duration of at most 168h, not %q", os.Getenv("RECORDING_S3_LINK_EXPIRY"))
+	}
+
+	client, err := minio.New(getEnv("RECORDING_S3_ENDPOINT", "s3.amazonaws.com"), &minio.Options{
+		Creds:  credentials.NewStaticV4(os.Getenv("RECORDING_S3_ACCESS_KEY"), os.Getenv("RECORDING_S3_SECRET_KEY"), ""),
+		Secure: useSSL,
+		Region: os.Getenv("RECORDING_S3_REGION"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create S3 client. reason: %s", err)
+	}
+
+	return &recordingArchive{client: client, bucket: bucket, linkExpiry: linkExpiry}, nil
+}
+
+// archive downloads the recording sid from Twilio, using the account
+// credentials, and uploads it to the bucket, as recordings/<sid>.mp3. It
+// returns a presigned link to the uploaded recording.
+func (a *recordingArchive) archive(ctx context.Context, accountSID, authToken, sid string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, recordingMediaURL(accountSID, sid, "mp3"), nil)
+	if err != nil {
+		return "", fmt.Errorf("could not download recording. reason: %s", err)
+	}
+	req.SetBasicAuth(accountSID, authToken)
+
+	timer := prometheus.NewTimer(twilioAPIDuration.WithLabelValues("download_recording"))
+	resp, err := http.DefaultClient.Do(req)
+	timer.ObserveDuration()
+	if err != nil {
+		return "", fmt.Errorf("could not download recording. reason: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not download recording. reason: Twilio returned %s", resp.Status)
+	}
+
+	object := "recordings/" + sid + ".mp3"
+	_, err = a.client.PutObject(ctx, a.bucket, object, resp.Body, resp.ContentLength, minio.PutObjectOptions{ContentType: "audio/mpeg"})
+	if err != nil {
+		return "", fmt.Errorf("could not upload recording. reason: %s", err)
+	}
+
+	link, err := a.client.PresignedGetObject(ctx, a.bucket, object, a.linkExpiry, nil)
+	if err != nil {
+		return "", fmt.Errorf("could not create a link to the uploaded recording. reason: %s", err)
+	}
+	return link.String(), nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+// twilioAPIBaseURL is where recordings are downloaded from
+const twilioAPIBaseURL = "https://api.twilio.com"
+
+// recordingSIDPattern matches Twilio recording SIDs, e.g.,
+// RE0123456789abcdef0123456789abcdef
+var recordingSIDPattern = regexp.MustCompile(`^RE[0-9a-f]{32}$`)
+
+// recordingProxyHeaders are the response headers which are passed from Twilio
+// through to the browser, so that it can play, and seek within, the recording
+var recordingProxyHeaders = []string{"Accept-Ranges", "Content-Length", "Content-Range", "Content-Type", "Last-Modified", "ETag"}
+
+// recordingToken returns the token which authorizes downloading the recording
+// sid through the proxy. It is derived from the auth token, so links can't be
+// forged, but don't need to be stored.
+func recordingToken(authToken, sid string) string {
+	mac := hmac.New(sha256.New, []byte(authToken))
+	mac.Write([]byte(sid))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// recordingLink returns the link to a recording which is included in voicemail
+// notifications. If sid is a recording SID, that is a link to the recording
+// proxy on this server, at origin; otherwise, it is recordingURL, which
+// requires the Twilio account credentials to open.
+func recordingLink(origin, authToken, sid, recordingURL string) string {
+	if recordingSIDPattern.MatchString(sid) {
+		query := url.Values{"token": {recordingToken(authToken, sid)}}
+		return fmt.Sprintf("%s/recordings/%s?%s", origin, sid, query.Encode())
+	}
+	if recordingURL == "" {
+		return ""
+	}
+	return recordingURL + ".mp3"
+}
+
+// recordingMediaURL returns the URL of the recording sid, in format, e.g., mp3,
+// on Twilio's API, which requires the account credentials to download
+func recordingMediaURL(accountSID, sid, format string) string {
+	return fmt.Sprintf("%s/2010-04-01/Accounts/%s/Recordings/%s.%s", twilioAPIBaseURL, accountSID, sid, format)
+}
+
+// proxyRecording returns a handler which downloads the recording in the path,
+// as an MP3, from Twilio, using the account credentials, and streams it to the
+// browser. The request must carry the recording's token, as in the links from
+// recordingLink. Range requests are passed through, so that the recording can
+// be seeked.
+func proxyRecording(accountSID, authToken string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sid := r.PathValue("sid")
+		token := r.URL.Query().Get("token")
+		if !recordingSIDPattern.MatchString(sid) || !hmac.Equal([]byte(token), []byte(recordingToken(authToken, sid))) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, recordingMediaURL(accountSID, sid, "mp3"), nil)
+		if err != nil {
+			appError(w, fmt.Errorf("could not download recording. reason: %s", err))
+			return
+		}
+		req.SetBasicAuth(accountSID, authToken)
+		if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			requestLogger(r).Error("Could not download recording", "recording_sid", sid, "error", err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+			requestLogger(r).Error("Twilio could not return recording", "recording_sid", sid, "status", resp.StatusCode)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+
+		for _, header := range recordingProxyHeaders {
+			if value := resp.Header.Get(header); value != "" {
+				w.Header().Set(header, value)
+			}
+		}
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", "audio/mpeg")
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}
+}
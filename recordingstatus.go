@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// handleRecordingStatus returns a handler which receives Twilio's recording
+// status callback, and, once the recording is completed, acknowledges it and
+// then, with tasks, so that Twilio isn't kept waiting, sends each of
+// notifiers a link to it, with the caller's number, from voicemailCall, and
+// its CallSid, which the later transcription is also sent with, to match the
+// two up. Twilio is always sent a 200, as for the transcription callback.
+func handleRecordingStatus(notifiers []notifier, tasks *backgroundTasks, cfg config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := requestLogger(r).With("recording_sid", r.FormValue("RecordingSid"), "recording_status", r.FormValue("RecordingStatus"))
+		if r.FormValue("RecordingStatus") != "completed" {
+			logger.Info("Recording is not complete, so no notification was sent")
+			acknowledgeCallback(w)
+			return
+		}
+
+		caller, called := voicemailCall(r, cfg.twilioAuthToken)
+		cfg := cfg.forCalled(called)
+		event := voicemailEvent{
+			Caller:               caller,
+			RecordingURL:         recordingLink(requestOrigin(r), cfg.twilioAuthToken, r.FormValue("RecordingSid"), r.FormValue("RecordingUrl")),
+			ReceivedAt:           requestTime(r).In(cfg.notifyLocation),
+			Reason:               routingReason(r.URL.Query().Get("reason")),
+			Language:             r.URL.Query().Get("language"),
+			CallSID:              r.FormValue("CallSid"),
+			TranscriptionPending: true,
+			timeLayout:           cfg.notifyTimeLayout,
+		}
+		acknowledgeCallback(w)
+		tasks.run(r.Context(), func(ctx context.Context) {
+			notifyAll(ctx, notifiers, event)
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// allowScript records a hit, scored by the time in milliseconds, in the
+// sorted set KEYS[1], unless it already has ARGV[3] hits within the window of
+// ARGV[2] milliseconds before ARGV[1]. It returns 1 if the hit was recorded.
+var allowScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+if redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call("ZADD", KEYS[1], now, ARGV[4])
+redis.call("PEXPIRE", KEYS[1], window)
+return 1
+`)
+
+// redisStore is a stateStore which keeps its state in Redis, so that it is
+// shared by every replica of the application. Keys are prefixed with prefix,
+// so that several deployments can share a Redis database.
+type redisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// newRedisStore connects to the Redis server at REDIS_URL, e.g.,
+// redis://localhost:6379/0, and returns a store which prefixes its keys with
+// REDIS_KEY_PREFIX, or nil if REDIS_URL is not set
+func newRedisStore(ctx context.Context) (*redisStore, error) {
+	value := os.Getenv("REDIS_URL")
+	if value == "" {
+		return nil, nil
+	}
+
+	options, err := redis.ParseURL(value)
+	if err != nil {
+		return nil, fmt.Errorf("REDIS_URL is not a valid Redis URL. reason: %s", err)
+	}
+	client := redis.NewClient(options)
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("could not connect to Redis. reason: %s", err)
+	}
+
+	return &redisStore{client: client, prefix: getEnv("REDIS_KEY_PREFIX", "call-forwarding:")}, nil
+}
+
+// close closes the connection to Redis
+func (s *redisStore) close() error {
+	return s.client.Close()
+}
+
+// allow records a hit for key, unless it already has limit hits within window
+func (s *redisStore) allow(ctx context.Context, key string, limit int, window time.Duration) (bool, error) {
+	now := clock()
+	recorded, err := allowScript.Run(ctx, s.client, []string{s.prefix + key}, now.UnixMilli(), window.Milliseconds(), limit, newRequestID()).Int()
+	if err != nil {
+		return false, err
+	}
+	return recorded == 1, nil
+}
+
+// claim records key for ttl, and reports whether it wasn't already recorded
+func (s *redisStore) claim(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	return s.client.SetNX(ctx, s.prefix+key, "1", ttl).Result()
+}
+
+// get returns the value of key, or an empty string if it isn't set
+func (s *redisStore) get(ctx context.Context, key string) (string, error) {
+	value, err := s.client.Get(ctx, s.prefix+key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return value, err
+}
+
+// set sets key to value for ttl, or until it is changed if ttl is 0. An empty
+// value deletes key.
+func (s *redisStore) set(ctx context.Context, key, value string, ttl time.Duration) error {
+	if value == "" {
+		return s.client.Del(ctx, s.prefix+key).Err()
+	}
+	return s.client.Set(ctx, s.prefix+key, value, ttl).Err()
+}
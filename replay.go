@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// replayGuard rejects Twilio requests which have already been handled, so
+// that a captured request, with a valid signature, can't be resent. Requests
+// are remembered by their signature, which differs for every distinct request,
+// for window, in store, so that a request can't be replayed to another
+// replica. A nil *replayGuard lets every request through.
+type replayGuard struct {
+	window time.Duration
+	store  stateStore
+}
+
+// newReplayGuard returns a guard which remembers requests for window, or nil,
+// letting every request through, if window isn't positive
+func newReplayGuard(window time.Duration, store stateStore) *replayGuard {
+	if window <= 0 {
+		return nil
+	}
+	return &replayGuard{window: window, store: store}
+}
+
+// fresh reports whether a request sent at timestamp is within the window of
+// now. Twilio includes a Timestamp with status callbacks, such as
+// /dial-status, but not with every request, so requests without one, or with
+// one that can't be parsed, are treated as fresh.
+func (g *replayGuard) fresh(timestamp string, now time.Time) bool {
+	sent, err := time.Parse(time.RFC1123Z, timestamp)
+	if err != nil {
+		return true
+	}
+	age := now.Sub(sent)
+	return age < g.window && age > -g.window
+}
+
+// firstSeen records signature, and reports whether it hadn't already been
+// seen within the window. If store can't be reached, the error is logged and
+// the request is treated as unseen, so that calls aren't dropped.
+func (g *replayGuard) firstSeen(ctx context.Context, signature string) bool {
+	first, err := g.store.claim(ctx, "replay:"+signature, g.window)
+	if err != nil {
+		contextLogger(ctx).Error("Could not check for a replayed request, letting it through", "error", err)
+		return true
+	}
+	return first
+}
+
+// check is middleware which rejects, with a 403, requests which are older than
+// the window or repeat an earlier request. It should wrap handlers inside
+// validateTwilioSignature, so that only requests from Twilio are remembered.
+// Requests without a signature, e.g., when signature validation is disabled,
+// are let through.
+func (g *replayGuard) check(next http.HandlerFunc) http.HandlerFunc {
+	if g == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		signature := r.Header.Get("X-Twilio-Signature")
+		if signature == "" {
+			next(w, r)
+			return
+		}
+
+		if !g.fresh(r.FormValue("Timestamp"), clock()) || !g.firstSeen(r.Context(), signature) {
+			requestLogger(r).Warn("Rejecting replayed Twilio request", "timestamp", r.FormValue("Timestamp"))
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
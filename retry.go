@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/twilio/twilio-go/client"
+	twilioAPI "github.com/twilio/twilio-go/rest/api/v2010"
+)
+
+// retryPolicy controls how failed requests to the Twilio API are retried
+type retryPolicy struct {
+	maxAttempts int
+	baseDelay   time.Duration
+}
+
+// backoff returns how long to wait before retrying after the given attempt.
+// The delay grows exponentially with each attempt, with full jitter, so that
+// retries from concurrent requests are spread out.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	ceiling := p.baseDelay << (attempt - 1)
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling)
+}
+
+// isTransientError checks if err is worth retrying, i.e., if it is a Twilio
+// server error (5xx), rate limiting (429), or a network error, rather than a
+// validation failure (4xx) or the request's context ending
+func isTransientError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var restErr *client.TwilioRestError
+	if errors.As(err, &restErr) {
+		return restErr.Status >= http.StatusInternalServerError || restErr.Status == http.StatusTooManyRequests
+	}
+
+	return true
+}
+
+// createMessageWithRetry sends an SMS message using sender, retrying transient
+// failures according to policy. All attempts, including the delays between
+// them, are bounded by ctx.
+func createMessageWithRetry(ctx context.Context, sender messageSender, params *twilioAPI.CreateMessageParams, policy retryPolicy, logger *slog.Logger) (*twilioAPI.ApiV2010Message, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := createMessageWithContext(ctx, sender, params)
+		if err == nil || attempt >= policy.maxAttempts || !isTransientError(err) {
+			return resp, err
+		}
+
+		delay := policy.backoff(attempt)
+		logger.Warn("Could not send voicemail SMS, retrying", "attempt", attempt, "delay", delay.String(), "error", err)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/twilio/twilio-go/twiml"
+)
+
+// discardedRecordingTTL is how long a discarded recording is remembered for,
+// which is comfortably longer than Twilio takes to transcribe it
+const discardedRecordingTTL = 24 * time.Hour
+
+// reviewPrompt is what callers are asked once they have recorded a voicemail,
+// when they may record it again
+const reviewPrompt = "To keep your message, press 1. To record it again, press 2."
+
+// rerecordPrompt is what callers who record their voicemail again are told,
+// unless RECORDING_PROMPT is set
+const rerecordPrompt = "Please record your message after the beep."
+
+// discardedRecordings remembers, in store, the recordings which callers chose
+// to record again, so that they aren't sent on as voicemails once Twilio has
+// transcribed them, even by another replica. A nil *discardedRecordings
+// discards nothing.
+type discardedRecordings struct {
+	store stateStore
+}
+
+// newDiscardedRecordings returns a set of discarded recordings, kept in store
+func newDiscardedRecordings(store stateStore) *discardedRecordings {
+	return &discardedRecordings{store: store}
+}
+
+// discard records that the recording sid was discarded
+func (d *discardedRecordings) discard(ctx context.Context, sid string) {
+	if d == nil || sid == "" {
+		return
+	}
+
+	if err := d.store.set(ctx, "discarded:"+sid, "1", discardedRecordingTTL); err != nil {
+		contextLogger(ctx).Error("Could not discard recording", "recording_sid", sid, "error", err)
+	}
+}
+
+// discarded reports whether the recording sid was discarded. If store can't
+// be reached, the error is logged and the recording is kept.
+func (d *discardedRecordings) discarded(ctx context.Context, sid string) bool {
+	if d == nil || sid == "" {
+		return false
+	}
+
+	value, err := d.store.get(ctx, "discarded:"+sid)
+	if err != nil {
+		contextLogger(ctx).Error("Could not check whether recording was discarded, keeping it", "recording_sid", sid, "error", err)
+		return false
+	}
+	return value != ""
+}
+
+// requestAttempt returns the attempt in the request's query string, which
+// voicemail recordings pass to /voicemail-complete, and callback number
+// prompts to /callback-number, or 1 if there isn't one
+func requestAttempt(r *http.Request) int {
+	attempt, err := strconv.Atoi(r.URL.Query().Get("attempt"))
+	if err != nil || attempt < 1 {
+		return 1
+	}
+	return attempt
+}
+
+// reviewElements returns the TwiML which asks the caller whether to keep the
+// recording sid, which was their attempt'th, or to record it again, and sends
+// their answer to /voicemail-review. If they don't answer, it is kept.
+func reviewElements(cfg config, reason routingReason, attempt int, sid string) []twiml.Element {
+	query := url.Values{}
+	query.Set("attempt", strconv.Itoa(attempt))
+	query.Set("recording", sid)
+	if reason != "" {
+		query.Set("reason", string(reason))
+	}
+
+	gather := &twiml.VoiceGather{
+		Action:    publicURL("/voicemail-review") + "?" + query.Encode(),
+		NumDigits: "1",
+		Timeout:   strconv.Itoa(cfg.menuTimeout),
+		InnerElements: []twiml.Element{
+			greetingElement(reviewPrompt),
+		},
+	}
+	return append([]twiml.Element{gather}, closingElements(cfg)...)
+}
+
+// handleVoicemailReview returns a handler which receives the key that the
+// caller pressed after recording their voicemail. On 2, the recording is
+// added to discarded, and they are asked to record it again; otherwise, it is
+// kept, and the call ends with closingElements.
+func handleVoicemailReview(discarded *discardedRecordings, cfg config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		attempt := requestAttempt(r)
+
+		elements := closingElements(cfg)
+		if r.FormValue("Digits") == "2" && attempt < cfg.recordingMaxAttempts {
+			discarded.discard(r.Context(), query.Get("recording"))
+			requestLogger(r).Info("Caller chose to record their voicemail again", "recording_sid", query.Get("recording"), "attempt", attempt)
+			prompt := cfg.recordingPrompt
+			if prompt == "" {
+				prompt = rerecordPrompt
+			}
+			elements = []twiml.Element{
+				greetingElement(prompt),
+				recordElement(cfg, routingReason(query.Get("reason")), attempt+1, r.FormValue("From"), r.FormValue("To")),
+			}
+		}
+
+		twimlResult, err := twiml.Voice(elements)
+		if err != nil {
+			appError(w, fmt.Errorf("could not review the voicemail. reason: %s", err))
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/xml")
+		w.Write([]byte(twimlResult))
+	}
+}
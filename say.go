@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/twilio/twilio-go/twiml"
+)
+
+// languagePattern matches the language tags that Twilio's <Say> accepts, e.g.,
+// en-US, pl-PL, or arb
+var languagePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Z]{2,3})?$`)
+
+// sayVoice returns the voice in the key environment variable, if it is one that
+// Twilio supports: man, woman, alice, or an Amazon Polly or Google voice, e.g.,
+// Polly.Zofia. Otherwise, it logs a warning and returns fallback.
+func sayVoice(key, fallback string) string {
+	voice := os.Getenv(key)
+	if voice == "" {
+		return fallback
+	}
+	if slices.Contains([]string{"man", "woman", "alice"}, voice) || strings.HasPrefix(voice, "Polly.") || strings.HasPrefix(voice, "Google.") {
+		return voice
+	}
+	slog.Warn("Unsupported voice, using the default instead", "key", key, "value", voice)
+	return fallback
+}
+
+// sayLanguage returns the language in the key environment variable, if it is a
+// valid language tag, e.g., pl-PL. Otherwise, it logs a warning and returns
+// fallback.
+func sayLanguage(key, fallback string) string {
+	language := os.Getenv(key)
+	if language == "" {
+		return fallback
+	}
+	if languagePattern.MatchString(language) {
+		return language
+	}
+	slog.Warn("Unsupported language, using the default instead", "key", key, "value", language)
+	return fallback
+}
+
+// sayElement returns a <Say> verb which speaks message in the voice and
+// language set by SAY_VOICE and SAY_LANGUAGE, or Twilio's defaults
+func sayElement(message string) *twiml.VoiceSay {
+	return &twiml.VoiceSay{
+		Message:  message,
+		Voice:    sayVoice("SAY_VOICE", ""),
+		Language: sayLanguage("SAY_LANGUAGE", ""),
+	}
+}
+
+// greetingElement returns a <Say> verb for greeting callers, which uses
+// GREETING_VOICE and GREETING_LANGUAGE, if set, in preference to SAY_VOICE and
+// SAY_LANGUAGE
+func greetingElement(message string) *twiml.VoiceSay {
+	say := sayElement(message)
+	say.Voice = sayVoice("GREETING_VOICE", say.Voice)
+	say.Language = sayLanguage("GREETING_LANGUAGE", say.Language)
+	return say
+}
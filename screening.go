@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/twilio/twilio-go/twiml"
+)
+
+// screeningElements returns the TwiML which asks the caller to press any key,
+// with SCREENING_PROMPT, and sends it to /screen. Callers who don't press one
+// within SCREENING_TIMEOUT seconds are sent to voicemail.
+func screeningElements(cfg config) []twiml.Element {
+	gather := &twiml.VoiceGather{
+		Action:    publicURL("/screen"),
+		NumDigits: "1",
+		Timeout:   strconv.Itoa(cfg.screeningTimeout),
+		InnerElements: []twiml.Element{
+			greetingElement(getEnv("SCREENING_PROMPT", "To be connected, please press any key.")),
+		},
+	}
+	return []twiml.Element{gather, voicemailRedirect(reasonUnscreened)}
+}
+
+// handleScreen returns a handler which receives the key that a screened caller
+// pressed, and forwards their call, as handleCallRequest would have, to the
+// forward numbers of the office that they called. Without a key, the caller is
+// sent to voicemail, if limiter allows it.
+func handleScreen(cfg config, limiter *rateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := cfg.forCalled(r.FormValue("To"))
+		caller := r.FormValue("From")
+		if normalized, err := normalizeNumber(caller); err == nil {
+			caller = normalized
+		}
+		logger := requestLogger(r).With("caller", caller)
+
+		var elements []twiml.Element
+		if r.FormValue("Digits") != "" {
+			numbers := forwardNumbersAt(clock().In(cfg.location), cfg.forwardWindows, cfg.forwardNumbers)
+			elements = forwardElements(cfg, numbers, caller, cfg.ringStrategy)
+			callsTotal.WithLabelValues("forward").Inc()
+			logger.Info("Routing call", "decision", "forward", "numbers", numbers)
+		} else {
+			elements = limiter.voicemail(r.Context(), cfg, reasonUnscreened, caller, r.FormValue("To"))
+			callsTotal.WithLabelValues("voicemail").Inc()
+			logger.Info("Routing call", "decision", "voicemail", "reason", reasonUnscreened)
+		}
+
+		twimlResult, err := twiml.Voice(elements)
+		if err != nil {
+			appError(w, fmt.Errorf("could not forward the screened call. reason: %s", err))
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/xml")
+		w.Write([]byte(twimlResult))
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// stateStore holds the state which every replica of the application must
+// agree on, such as rate limits, replayed requests, and the business hours
+// override. It is kept in Redis, with redisStore, if REDIS_URL is set, or in
+// memory, with memoryStore, otherwise.
+type stateStore interface {
+	// allow records a hit for key, unless it already has limit hits within
+	// window, and reports whether it was recorded
+	allow(ctx context.Context, key string, limit int, window time.Duration) (bool, error)
+	// claim records key for ttl, and reports whether it wasn't already
+	// recorded
+	claim(ctx context.Context, key string, ttl time.Duration) (bool, error)
+	// get returns the value of key, or an empty string if it isn't set
+	get(ctx context.Context, key string) (string, error)
+	// set sets key to value for ttl, or until it is changed if ttl is 0. An
+	// empty value deletes key.
+	set(ctx context.Context, key, value string, ttl time.Duration) error
+}
+
+// memoryValue is a value in a memoryStore, which expires at expires, unless
+// that is the zero time
+type memoryValue struct {
+	value   string
+	expires time.Time
+}
+
+// expired reports whether v has expired at now
+func (v memoryValue) expired(now time.Time) bool {
+	return !v.expires.IsZero() && !now.Before(v.expires)
+}
+
+// hitLog is the hits recorded for a key in a memoryStore, oldest first, within
+// window
+type hitLog struct {
+	window time.Duration
+	hits   []time.Time
+}
+
+// recent returns the hits which are still within the window at now
+func (l hitLog) recent(now time.Time) []time.Time {
+	hits := l.hits
+	cutoff := now.Add(-l.window)
+	for len(hits) > 0 && !hits[0].After(cutoff) {
+		hits = hits[1:]
+	}
+	return hits
+}
+
+// memoryStore is a stateStore which keeps its state in memory, so it is only
+// shared by the requests to a single replica, and is lost on restart
+type memoryStore struct {
+	mu     sync.Mutex
+	hits   map[string]hitLog
+	values map[string]memoryValue
+}
+
+// newMemoryStore returns an empty memoryStore
+func newMemoryStore() *memoryStore {
+	return &memoryStore{hits: map[string]hitLog{}, values: map[string]memoryValue{}}
+}
+
+// allow records a hit for key, unless it already has limit hits within window.
+// Hits over the limit aren't recorded, so that a caller who keeps trying is
+// let through again once their earlier hits leave the window.
+func (s *memoryStore) allow(ctx context.Context, key string, limit int, window time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := clock()
+	log := hitLog{window: window, hits: s.hits[key].recent(now)}
+	if len(log.hits) >= limit {
+		s.hits[key] = log
+		return false, nil
+	}
+	log.hits = append(log.hits, now)
+	s.hits[key] = log
+	return true, nil
+}
+
+// claim records key for ttl, and reports whether it wasn't already recorded
+func (s *memoryStore) claim(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := clock()
+	if value, ok := s.values[key]; ok && !value.expired(now) {
+		return false, nil
+	}
+	s.values[key] = memoryValue{value: "1", expires: now.Add(ttl)}
+	return true, nil
+}
+
+// get returns the value of key, or an empty string if it isn't set
+func (s *memoryStore) get(ctx context.Context, key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if value, ok := s.values[key]; ok && !value.expired(clock()) {
+		return value.value, nil
+	}
+	return "", nil
+}
+
+// set sets key to value for ttl, or until it is changed if ttl is 0. An empty
+// value deletes key.
+func (s *memoryStore) set(ctx context.Context, key, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if value == "" {
+		delete(s.values, key)
+		return nil
+	}
+	stored := memoryValue{value: value}
+	if ttl > 0 {
+		stored.expires = clock().Add(ttl)
+	}
+	s.values[key] = stored
+	return nil
+}
+
+// cleanup forgets keys with no hits within their window, and values which have
+// expired, so that the store doesn't grow with every number that has ever
+// called, and every request that has ever been made
+func (s *memoryStore) cleanup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := clock()
+	for key, log := range s.hits {
+		if log.hits = log.recent(now); len(log.hits) == 0 {
+			delete(s.hits, key)
+		} else {
+			s.hits[key] = log
+		}
+	}
+	for key, value := range s.values {
+		if value.expired(now) {
+			delete(s.values, key)
+		}
+	}
+}
+
+// cleanupEvery runs cleanup every interval until ctx is done
+func (s *memoryStore) cleanupEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.cleanup()
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// maxStatusLookahead is how far ahead nextChange looks for the business to open
+// or close, so that a schedule with no business hours doesn't loop forever
+const maxStatusLookahead = 366
+
+// nextChange returns the first time after now at which the business opens, if
+// it is closed at now, or closes, if it is open. If that doesn't happen within
+// maxStatusLookahead days, ok is false.
+func nextChange(now time.Time, cfg config) (change time.Time, ok bool) {
+	open, _ := cfg.businessHours(now)
+
+	year, month, day := now.Date()
+	for offset := 0; offset <= maxStatusLookahead; offset++ {
+		midnight := time.Date(year, month, day+offset, 0, 0, 0, 0, now.Location())
+
+		hours := cfg.workDayHours
+		if len(cfg.workHours) > 0 {
+			hours = cfg.workHours[midnight.Weekday()]
+		}
+		if dateHours, ok := cfg.openDates.hours(midnight); ok {
+			hours = dateHours
+		}
+
+		candidates := []time.Time{midnight}
+		for _, i := range hours {
+			candidates = append(candidates, dayBoundary(midnight, i.start), dayBoundary(midnight, i.end))
+		}
+		nextMidnight := time.Date(year, month, day+offset+1, 0, 0, 0, 0, now.Location())
+		for _, t := range []time.Time{cfg.vacationStart, cfg.vacationEnd} {
+			if !t.Before(midnight) && t.Before(nextMidnight) {
+				candidates = append(candidates, t)
+			}
+		}
+		slices.SortFunc(candidates, time.Time.Compare)
+
+		for _, candidate := range candidates {
+			if !candidate.After(now) {
+				continue
+			}
+			if candidateOpen, _ := cfg.businessHours(candidate); candidateOpen != open {
+				return candidate, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// handleStatus reports, as JSON, whether the business is currently open, why,
+// and when that next changes, e.g., for a status page. next_change is omitted
+// if the business doesn't open or close within the next year, or while
+// override is set, along with which override is set.
+func handleStatus(cfg config, override *hoursOverride) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := clock().In(cfg.location)
+		mode := override.current(r.Context())
+		open, reason := mode.apply(cfg.businessHours(now))
+
+		status := struct {
+			Open       bool          `json:"open"`
+			Reason     routingReason `json:"reason"`
+			Override   overrideMode  `json:"override,omitempty"`
+			NextChange *time.Time    `json:"next_change,omitempty"`
+		}{Open: open, Reason: reason, Override: mode}
+		if change, ok := nextChange(now, cfg); ok && mode == overrideNone {
+			change = change.UTC()
+			status.NextChange = &change
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// migrations bring the database schema up to date, and are applied in order on
+// startup. The number applied so far is tracked in SQLite's user_version, so
+// only ever append to this list.
+var migrations = []string{
+	`CREATE TABLE voicemails (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		caller TEXT NOT NULL,
+		received_at INTEGER NOT NULL,
+		recording_url TEXT NOT NULL,
+		transcription TEXT NOT NULL
+	)`,
+	`CREATE INDEX voicemails_received_at ON voicemails (received_at)`,
+	`ALTER TABLE voicemails ADD COLUMN call_sid TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE voicemails ADD COLUMN called TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE voicemails ADD COLUMN direction TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE voicemails ADD COLUMN duration INTEGER NOT NULL DEFAULT 0`,
+}
+
+// voicemail is a voicemail left by a caller, along with details of the call,
+// from Twilio, for finding it in the Twilio Console
+type voicemail struct {
+	ID            int64     `json:"id"`
+	Caller        string    `json:"caller"`
+	ReceivedAt    time.Time `json:"received_at"`
+	RecordingURL  string    `json:"recording_url"`
+	Transcription string    `json:"transcription"`
+	CallSID       string    `json:"call_sid"`
+	Called        string    `json:"called"`
+	Direction     string    `json:"direction"`
+	// Duration is the length of the recording, in seconds, if Twilio sent it
+	Duration int `json:"duration"`
+}
+
+// voicemailStore persists voicemails in a SQLite database
+type voicemailStore struct {
+	db *sql.DB
+}
+
+// openVoicemailStore opens, or creates, the SQLite database at path and applies
+// any outstanding migrations
+func openVoicemailStore(path string) (*voicemailStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &voicemailStore{db: db}
+	if err := store.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not migrate database. reason: %s", err)
+	}
+	return store, nil
+}
+
+// migrate applies the migrations which haven't yet been applied to the database
+func (s *voicemailStore) migrate() error {
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// close closes the underlying database
+func (s *voicemailStore) close() error {
+	return s.db.Close()
+}
+
+// save inserts v into the database
+func (s *voicemailStore) save(ctx context.Context, v voicemail) error {
+	_, err := s.db.ExecContext(
+		ctx,
+		"INSERT INTO voicemails (caller, received_at, recording_url, transcription, call_sid, called, direction, duration) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		v.Caller, v.ReceivedAt.Unix(), v.RecordingURL, v.Transcription, v.CallSID, v.Called, v.Direction, v.Duration,
+	)
+	return err
+}
+
+// list returns the voicemails received from from, up to but not including to,
+// newest first. If either is the zero time, that end of the range is open.
+func (s *voicemailStore) list(ctx context.Context, from, to time.Time) ([]voicemail, error) {
+	query := "SELECT id, caller, received_at, recording_url, transcription, call_sid, called, direction, duration FROM voicemails WHERE 1 = 1"
+	var args []any
+	if !from.IsZero() {
+		query += " AND received_at >= ?"
+		args = append(args, from.Unix())
+	}
+	if !to.IsZero() {
+		query += " AND received_at < ?"
+		args = append(args, to.Unix())
+	}
+	query += " ORDER BY received_at DESC, id DESC"
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	voicemails := []voicemail{}
+	for rows.Next() {
+		var v voicemail
+		var receivedAt int64
+		if err := rows.Scan(&v.ID, &v.Caller, &receivedAt, &v.RecordingURL, &v.Transcription, &v.CallSID, &v.Called, &v.Direction, &v.Duration); err != nil {
+			return nil, err
+		}
+		v.ReceivedAt = time.Unix(receivedAt, 0).UTC()
+		voicemails = append(voicemails, v)
+	}
+	return voicemails, rows.Err()
+}
+
+// parseDateFilter parses a from or to filter, which is either an RFC 3339
+// timestamp, or a YYYY-MM-DD date in loc. If endOfDay is true, a date is taken
+// to mean the end of that day, so that the range includes it.
+func parseDateFilter(value string, loc *time.Location, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not a valid date; use YYYY-MM-DD or RFC 3339", value)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// listVoicemails returns a handler which lists the stored voicemails as JSON,
+// optionally filtered with the from and to query parameters. Dates without a
+// time are in location, and both ends of the range are inclusive.
+func listVoicemails(store *voicemailStore, location *time.Location) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		from, err := parseDateFilter(r.URL.Query().Get("from"), location, false)
+		if err != nil {
+			appError(w, badRequest(fmt.Errorf("invalid from filter. reason: %s", err)))
+			return
+		}
+		to, err := parseDateFilter(r.URL.Query().Get("to"), location, true)
+		if err != nil {
+			appError(w, badRequest(fmt.Errorf("invalid to filter. reason: %s", err)))
+			return
+		}
+
+		voicemails, err := store.list(r.Context(), from, to)
+		if err != nil {
+			appError(w, fmt.Errorf("could not list voicemails. reason: %s", err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(voicemails)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/twilio/twilio-go/twiml"
+)
+
+// twimlTemplateData is what TWIML_TEMPLATE is rendered with. Every field,
+// other than Default, is escaped for XML, so it can be used in text and
+// attributes as is.
+type twimlTemplateData struct {
+	// Decision is how the call was routed, as in calls_total, e.g., forward
+	Decision string
+	// Reason is why the call was, or wasn't, routed as during business hours
+	Reason string
+	Caller string
+	Called string
+	// Numbers are the numbers the call is forwarded to, if any
+	Numbers  []string
+	Timezone string
+	// BaseURL is PUBLIC_BASE_URL, for the URLs of this application's
+	// callbacks, e.g., {{.BaseURL}}/dial-status
+	BaseURL string
+	// Default is the TwiML which would have been returned without the
+	// template, unescaped, e.g., to fall back to for some decisions
+	Default string
+}
+
+// twimlTemplate renders the TwiML returned to calls from a user-supplied
+// text/template, instead of the built-in TwiML. A nil *twimlTemplate returns
+// the built-in TwiML.
+type twimlTemplate struct {
+	tmpl *template.Template
+}
+
+// loadTwiMLTemplate parses the template at TWIML_TEMPLATE, and checks that it
+// renders valid TwiML, with cfg's voicemail as its Default, for every
+// decision, or returns nil if TWIML_TEMPLATE isn't set
+func loadTwiMLTemplate(cfg config) (*twimlTemplate, error) {
+	path := os.Getenv("TWIML_TEMPLATE")
+	if path == "" {
+		return nil, nil
+	}
+
+	tmpl, err := template.ParseFiles(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse TWIML_TEMPLATE. reason: %s", err)
+	}
+	t := &twimlTemplate{tmpl: tmpl}
+
+	elements := voicemailElements(cfg, reasonAfterHours, "+14155552671", "+14155550100")
+	for _, decision := range []string{"forward", "screen", "queue", "conference", "on_call", "voicemail", "blocked", "rate_limited"} {
+		data := twimlTemplateData{Decision: decision, Reason: string(reasonAfterHours), Caller: "+14155552671", Called: "+14155550100", Numbers: []string{"+14155550101"}, Timezone: "UTC"}
+		if _, err := t.voice(elements, data); err != nil {
+			return nil, fmt.Errorf("TWIML_TEMPLATE does not render valid TwiML for %s calls. reason: %s", decision, err)
+		}
+	}
+	return t, nil
+}
+
+// escapeXML returns value escaped for use in XML text or attributes
+func escapeXML(value string) string {
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(value))
+	return escaped.String()
+}
+
+// voice returns the TwiML for a call described by data: elements, if t is
+// nil, or the template, rendered with data and elements as its Default,
+// otherwise. The rendered TwiML must be well-formed XML, with a <Response>
+// root element.
+func (t *twimlTemplate) voice(elements []twiml.Element, data twimlTemplateData) (string, error) {
+	builtin, err := twiml.Voice(elements)
+	if err != nil || t == nil {
+		return builtin, err
+	}
+
+	data.Decision, data.Reason = escapeXML(data.Decision), escapeXML(data.Reason)
+	data.Caller, data.Called = escapeXML(data.Caller), escapeXML(data.Called)
+	data.Timezone, data.BaseURL = escapeXML(data.Timezone), escapeXML(data.BaseURL)
+	numbers := make([]string, len(data.Numbers))
+	for i, number := range data.Numbers {
+		numbers[i] = escapeXML(number)
+	}
+	data.Numbers = numbers
+	data.Default = builtin
+
+	var rendered bytes.Buffer
+	if err := t.tmpl.Execute(&rendered, data); err != nil {
+		return "", err
+	}
+	if err := validateTwiML(rendered.Bytes()); err != nil {
+		return "", err
+	}
+	return rendered.String(), nil
+}
+
+// validateTwiML checks that document is well-formed XML, with a <Response>
+// root element
+func validateTwiML(document []byte) error {
+	decoder := xml.NewDecoder(bytes.NewReader(document))
+	root := ""
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("the TwiML is not valid XML: %s", err)
+		}
+		if start, ok := token.(xml.StartElement); ok && root == "" {
+			root = start.Name.Local
+		}
+	}
+	if root == "" {
+		return errors.New("the TwiML has no <Response> element")
+	}
+	if root != "Response" {
+		return fmt.Errorf("the TwiML must have a <Response> root element, not <%s>", root)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// testNotificationResult is the outcome of sending the test notification over
+// one channel
+type testNotificationResult struct {
+	Channel string `json:"channel"`
+	Error   string `json:"error,omitempty"`
+}
+
+// resultNotifier is a notifier which records the outcome of each notification
+// in result, as notifyAll only logs failures
+type resultNotifier struct {
+	notifier
+	result *testNotificationResult
+}
+
+// notify sends event with the wrapped notifier, recording any error
+func (n resultNotifier) notify(ctx context.Context, event voicemailEvent) error {
+	err := n.notifier.notify(ctx, event)
+	if err != nil {
+		n.result.Error = err.Error()
+	}
+	return err
+}
+
+// handleTestNotification returns a handler which sends a canned voicemail to
+// each of notifiers, with notifyAll, in the same way as for a real voicemail,
+// so that the notification settings, e.g., SMS, email, or Slack, can be
+// checked without placing a call. It reports the outcome on each channel as
+// JSON, with a 502 if any of them failed.
+func handleTestNotification(notifiers []notifier, cfg config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		event := voicemailEvent{
+			Transcription: "This is a test voicemail notification.",
+			ReceivedAt:    requestTime(r).In(cfg.notifyLocation),
+			timeLayout:    cfg.notifyTimeLayout,
+		}
+
+		results := make([]testNotificationResult, len(notifiers))
+		recorded := make([]notifier, len(notifiers))
+		for i, n := range notifiers {
+			results[i].Channel = n.channel()
+			recorded[i] = resultNotifier{notifier: n, result: &results[i]}
+		}
+		notifyAll(r.Context(), recorded, event)
+
+		status := http.StatusOK
+		for _, result := range results {
+			if result.Error != "" {
+				status = http.StatusBadGateway
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]any{"results": results})
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+)
+
+// transcribeLanguages are the languages which Twilio can transcribe voicemails
+// in. Twilio's transcription only supports English.
+var transcribeLanguages = []string{"en-US"}
+
+// transcribeLanguage returns the language that voicemails are left in, from
+// TRANSCRIBE_LANGUAGE, or an empty string if it is not set, in which case
+// English is assumed
+func transcribeLanguage() string {
+	return os.Getenv("TRANSCRIBE_LANGUAGE")
+}
+
+// canTranscribe reports whether Twilio can transcribe voicemails left in
+// TRANSCRIBE_LANGUAGE
+func canTranscribe() bool {
+	language := transcribeLanguage()
+	return language == "" || slices.Contains(transcribeLanguages, language)
+}
+
+// validateTranscribeLanguage checks that TRANSCRIBE_LANGUAGE, if set, is a
+// language tag, e.g., pl-PL. If provider is Twilio, and it can't transcribe
+// it, a warning is logged, since voicemails will be sent without a
+// transcription.
+func validateTranscribeLanguage(provider string) error {
+	language := transcribeLanguage()
+	if language == "" {
+		return nil
+	}
+	if !languagePattern.MatchString(language) {
+		return fmt.Errorf("TRANSCRIBE_LANGUAGE must be a language tag, e.g., en-US, not %q", language)
+	}
+	if !canTranscribe() && provider == transcribeProviderTwilio {
+		slog.Warn("Twilio can't transcribe TRANSCRIBE_LANGUAGE, so voicemails will be sent without a transcription", "language", language, "supported", transcribeLanguages)
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/twilio/twilio-go/twiml"
+)
+
+// The services which can transcribe voicemails, set with TRANSCRIBE_PROVIDER
+const (
+	transcribeProviderTwilio  = "twilio"
+	transcribeProviderWebhook = "webhook"
+)
+
+// recordingContentTypes are the formats, set with RECORDING_FORMAT, which
+// recordings can be sent to TRANSCRIBE_WEBHOOK_URL in, and their content types
+var recordingContentTypes = map[string]string{
+	"mp3": "audio/mpeg",
+	"wav": "audio/wav",
+}
+
+// transcriber transcribes voicemails. twilioTranscriber, the default, has
+// Twilio transcribe them, and webhookTranscriber sends them to another
+// service instead.
+type transcriber interface {
+	// configure sets up record so that, once the voicemail is recorded, and
+	// transcribed, if Twilio transcribes it, Twilio sends it to callback
+	configure(record *twiml.VoiceRecord, callback string)
+	// transcribe returns the transcription of the voicemail which Twilio's
+	// callback r is for, using the account credentials to download it if
+	// need be, or an empty string if it has none
+	transcribe(ctx context.Context, accountSID, authToken string, r *http.Request) (string, error)
+}
+
+// recordingFormat returns RECORDING_FORMAT, wav by default
+func recordingFormat() string {
+	return getEnv("RECORDING_FORMAT", "wav")
+}
+
+// newTranscriber returns the transcriber set with TRANSCRIBE_PROVIDER, which
+// must be twilio or webhook: a twilioTranscriber, if it is twilio, or a
+// webhookTranscriber, configured from TRANSCRIBE_WEBHOOK_URL, which must be an
+// absolute http or https URL, TRANSCRIBE_WEBHOOK_TOKEN,
+// TRANSCRIBE_WEBHOOK_TIMEOUT, and RECORDING_FORMAT, which must be mp3 or wav,
+// if it is webhook
+func newTranscriber(cfg config) (transcriber, error) {
+	switch cfg.transcribeProvider {
+	case transcribeProviderTwilio:
+		return twilioTranscriber{notifyOnRecording: cfg.notifyOnRecording}, nil
+	case transcribeProviderWebhook:
+	default:
+		return nil, fmt.Errorf("TRANSCRIBE_PROVIDER must be %s or %s, not %q", transcribeProviderTwilio, transcribeProviderWebhook, cfg.transcribeProvider)
+	}
+
+	value := os.Getenv("TRANSCRIBE_WEBHOOK_URL")
+	if u, err := url.Parse(value); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("TRANSCRIBE_WEBHOOK_URL must be an absolute http or https URL when TRANSCRIBE_PROVIDER is webhook, not %q", value)
+	}
+	format := recordingFormat()
+	if recordingContentTypes[format] == "" {
+		return nil, fmt.Errorf("RECORDING_FORMAT must be mp3 or wav, not %q", format)
+	}
+	timeout, err := getEnvDuration("TRANSCRIBE_WEBHOOK_TIMEOUT", 10*time.Second, time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	return &webhookTranscriber{
+		client: &http.Client{Timeout: timeout},
+		url:    value,
+		token:  os.Getenv("TRANSCRIBE_WEBHOOK_TOKEN"),
+		format: format,
+	}, nil
+}
+
+// twilioTranscriber has Twilio transcribe voicemails, using its built-in
+// transcription. With notifyOnRecording, Twilio also sends each recording on
+// as soon as it is ready, before it has been transcribed.
+type twilioTranscriber struct {
+	notifyOnRecording bool
+}
+
+// configure has Twilio transcribe the recording, and send the transcription to
+// callback, or, if Twilio can't transcribe TRANSCRIBE_LANGUAGE, has it send
+// just the recording there, in a recording status callback, which relies on
+// callback's query for the caller's number. With NOTIFY_ON_RECORDING, the
+// recording is also sent to /recording-status, with callback's query, as soon
+// as it is ready.
+func (t twilioTranscriber) configure(record *twiml.VoiceRecord, callback string) {
+	if !canTranscribe() {
+		record.RecordingStatusCallback = callback
+		return
+	}
+	record.Transcribe = "true"
+	record.TranscribeCallback = callback
+	if t.notifyOnRecording {
+		record.RecordingStatusCallback = publicURL("/recording-status")
+		if _, query, ok := strings.Cut(callback, "?"); ok {
+			record.RecordingStatusCallback += "?" + query
+		}
+		record.RecordingStatusCallbackEvent = "completed"
+	}
+}
+
+// transcribe returns the TranscriptionText that Twilio sent. When
+// transcription fails, Twilio may still send partial or empty text, which
+// isn't worth passing on, so it is an error instead.
+func (twilioTranscriber) transcribe(ctx context.Context, accountSID, authToken string, r *http.Request) (string, error) {
+	if status := r.FormValue("TranscriptionStatus"); status == "failed" {
+		return "", fmt.Errorf("Twilio could not transcribe the voicemail, its TranscriptionStatus is %s", status)
+	}
+	return r.FormValue("TranscriptionText"), nil
+}
+
+// webhookTranscriber transcribes voicemails with another service, by
+// downloading each recording from Twilio, in format, and posting it to url,
+// with token, if there is one, as a bearer token
+type webhookTranscriber struct {
+	client *http.Client
+	url    string
+	token  string
+	format string
+}
+
+// webhookTranscription is the JSON that TRANSCRIBE_WEBHOOK_URL responds with
+type webhookTranscription struct {
+	Transcription string `json:"transcription"`
+}
+
+// configure has Twilio send the recording, without transcribing it, to
+// callback, once it is complete
+func (t *webhookTranscriber) configure(record *twiml.VoiceRecord, callback string) {
+	record.RecordingStatusCallback = callback
+	record.RecordingStatusCallbackEvent = "completed"
+}
+
+// transcribe downloads the recording, and posts it to the webhook, along with
+// the call_sid, recording_sid, and language, if known, as query parameters. It
+// returns the transcription from the webhook's response.
+func (t *webhookTranscriber) transcribe(ctx context.Context, accountSID, authToken string, r *http.Request) (string, error) {
+	sid := r.FormValue("RecordingSid")
+	if !recordingSIDPattern.MatchString(sid) {
+		return "", fmt.Errorf("could not download recording. reason: %q is not a recording SID", sid)
+	}
+
+	download, err := http.NewRequestWithContext(ctx, http.MethodGet, recordingMediaURL(accountSID, sid, t.format), nil)
+	if err != nil {
+		return "", fmt.Errorf("could not download recording. reason: %s", err)
+	}
+	download.SetBasicAuth(accountSID, authToken)
+
+	timer := prometheus.NewTimer(twilioAPIDuration.WithLabelValues("download_recording"))
+	recording, err := t.client.Do(download)
+	timer.ObserveDuration()
+	if err != nil {
+		return "", fmt.Errorf("could not download recording. reason: %s", err)
+	}
+	defer recording.Body.Close()
+	if recording.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not download recording. reason: Twilio returned %s", recording.Status)
+	}
+
+	u, err := url.Parse(t.url)
+	if err != nil {
+		return "", fmt.Errorf("could not transcribe recording. reason: %s", err)
+	}
+	query := u.Query()
+	query.Set("call_sid", r.FormValue("CallSid"))
+	query.Set("recording_sid", sid)
+	if language := r.URL.Query().Get("language"); language != "" {
+		query.Set("language", language)
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), recording.Body)
+	if err != nil {
+		return "", fmt.Errorf("could not transcribe recording. reason: %s", err)
+	}
+	req.ContentLength = recording.ContentLength
+	req.Header.Set("Content-Type", recordingContentTypes[t.format])
+	if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not transcribe recording. reason: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("could not transcribe recording. reason: %s responded with %s", u.Host, resp.Status)
+	}
+
+	var result webhookTranscription
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("could not read transcription. reason: %s", err)
+	}
+	return result.Transcription, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/twilio/twilio-go/twiml"
+)
+
+// whisperEnabled reports whether staff hear a whisper, set with
+// WHISPER_MESSAGE, before a forwarded call is connected
+func whisperEnabled() bool {
+	return os.Getenv("WHISPER_MESSAGE") != ""
+}
+
+// forwardedLegURL returns the URL which Twilio requests, on the forwarded leg
+// of the call, before connecting caller, or an empty string if there is
+// nothing to do. With answering machine detection enabled, that is
+// /machine-detection, which also plays the whisper if a person answered.
+func forwardedLegURL(caller string) string {
+	query := "?" + url.Values{"caller": {caller}}.Encode()
+	switch {
+	case machineDetectionEnabled():
+		return publicURL("/machine-detection" + query)
+	case whisperEnabled():
+		return publicURL("/whisper" + query)
+	default:
+		return ""
+	}
+}
+
+// spokenNumber spells out number digit by digit, so that it is read out as a
+// phone number rather than as one very large number
+func spokenNumber(number string) string {
+	digits := strings.Split(strings.TrimPrefix(number, "+"), "")
+	return strings.Join(digits, " ")
+}
+
+// whisperElements returns the TwiML which the person answering a forwarded
+// call hears, before the caller is connected, so they know that it is a
+// business call. {caller} in WHISPER_MESSAGE is replaced with the caller's
+// number or, if they withheld it, or it isn't a phone number, "an unknown
+// number".
+func whisperElements(caller string) []twiml.Element {
+	if !whisperEnabled() {
+		return nil
+	}
+	spoken := "an unknown number"
+	if validateE164(caller) == nil {
+		spoken = spokenNumber(caller)
+	}
+	message := strings.ReplaceAll(os.Getenv("WHISPER_MESSAGE"), "{caller}", spoken)
+	return []twiml.Element{sayElement(message)}
+}
+
+// handleWhisper is requested by Twilio, on the forwarded leg of the call, when
+// it is answered, and plays the whisper before the caller is connected
+func handleWhisper(w http.ResponseWriter, r *http.Request) {
+	twimlResult, err := twiml.Voice(whisperElements(r.URL.Query().Get("caller")))
+	if err != nil {
+		appError(w, fmt.Errorf("could not whisper to the forwarded call. reason: %s", err))
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/xml")
+	w.Write([]byte(twimlResult))
+}